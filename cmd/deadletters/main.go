@@ -0,0 +1,105 @@
+// Command deadletters inspects the dead letters kept by the consumer and
+// re-injects them through its push receiver once the cause has been fixed.
+// Dead letters keep their source only if the receiver trusts its clients.
+//
+//	deadletters inspect [-file deadletters.jsonl] [-stage decode]
+//	deadletters reinject [-file deadletters.jsonl] [-stage handle] -url http://localhost:9090/metrics
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/sambarnes/demoware-consumer/metrics"
+	log "github.com/sirupsen/logrus"
+)
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: deadletters inspect|reinject [flags]")
+	os.Exit(2)
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+	flags := flag.NewFlagSet(os.Args[1], flag.ExitOnError)
+	path := flags.String("file", "deadletters.jsonl", "dead letter file written by the consumer")
+	stage := flags.String("stage", "", "only include dead letters from this stage (decode, dispatch or handle)")
+	url := flags.String("url", "", "push receiver to re-inject dead letters into")
+	flags.Parse(os.Args[2:])
+
+	letters, err := metrics.ReadDeadLetters(*path)
+	if err != nil {
+		log.Fatal(err)
+	}
+	selected := make([]metrics.DeadLetter, 0, len(letters))
+	for _, letter := range letters {
+		if *stage == "" || letter.Stage == *stage {
+			selected = append(selected, letter)
+		}
+	}
+
+	switch os.Args[1] {
+	case "inspect":
+		inspect(selected)
+	case "reinject":
+		if *url == "" {
+			log.Fatal("reinject requires -url")
+		}
+		reinject(selected, *url)
+	default:
+		usage()
+	}
+}
+
+func inspect(letters []metrics.DeadLetter) {
+	for _, letter := range letters {
+		batch := letter.Batch()
+		if 120 < len(batch) {
+			batch = append(batch[:117:117], "..."...)
+		}
+		fmt.Printf("%v\t%v\t%v\t%v\t%v\t%s\n",
+			letter.Time.Format(time.RFC3339), letter.Stage, letter.Source, letter.Type, letter.Reason, batch)
+	}
+	fmt.Fprintf(os.Stderr, "%v dead letters\n", len(letters))
+}
+
+func reinject(letters []metrics.DeadLetter, url string) {
+	client := &http.Client{Timeout: 10 * time.Second}
+	failed := 0
+	for _, letter := range letters {
+		req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(letter.Batch()))
+		if err != nil {
+			log.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		if letter.Source != "" {
+			req.Header.Set(metrics.SourceHeader, letter.Source)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			log.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusAccepted {
+			failed++
+			log.WithFields(log.Fields{
+				"status": resp.Status,
+				"stage":  letter.Stage,
+				"source": letter.Source,
+			}).Warn("Dead letter rejected")
+		}
+	}
+	log.WithFields(log.Fields{
+		"reinjected": len(letters) - failed,
+		"rejected":   failed,
+	}).Info("Finished re-injecting dead letters")
+	if 0 < failed {
+		os.Exit(1)
+	}
+}
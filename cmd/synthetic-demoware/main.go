@@ -0,0 +1,43 @@
+// Command synthetic-demoware serves randomly generated metrics in the same
+// shape as the demoware API, for running the consumer without the real service
+package main
+
+import (
+	"flag"
+	"net/http"
+
+	"github.com/sambarnes/demoware-consumer/metrics"
+	log "github.com/sirupsen/logrus"
+)
+
+func main() {
+	addr := flag.String("addr", ":8080", "address to serve /metrics on")
+	cpuCount := flag.Int("cpus", 4, "number of CPU cores to report usage for")
+	batchSize := flag.Int("batch-size", 3, "number of metrics per batch")
+	loadMean := flag.Float64("load-mean", 1, "mean load average")
+	loadStdDev := flag.Float64("load-stddev", 0.5, "standard deviation of the load average")
+	cpuMean := flag.Float64("cpu-mean", 50, "mean per-core CPU usage")
+	cpuStdDev := flag.Float64("cpu-stddev", 20, "standard deviation of per-core CPU usage")
+	errorRate := flag.Float64("error-rate", 0, "fraction of requests answered with a 500")
+	malformedRate := flag.Float64("malformed-rate", 0, "fraction of batches with invalid JSON")
+	seed := flag.Int64("seed", 0, "random seed, or 0 for a time-based seed")
+	flag.Parse()
+
+	server, err := metrics.NewSyntheticServer(metrics.SyntheticConfig{
+		CPUCount:      *cpuCount,
+		Load:          metrics.Normal{Mean: *loadMean, StdDev: *loadStdDev, Min: 0, Max: float64(*cpuCount)},
+		CPUUsage:      metrics.Normal{Mean: *cpuMean, StdDev: *cpuStdDev, Min: 0, Max: 100},
+		BatchSize:     *batchSize,
+		ErrorRate:     *errorRate,
+		MalformedRate: *malformedRate,
+		Seed:          *seed,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", server)
+	log.WithField("addr", *addr).Info("Serving synthetic demoware metrics")
+	log.Fatal(http.ListenAndServe(*addr, mux))
+}
@@ -1,61 +1,261 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/sambarnes/demoware-consumer/metrics"
 	log "github.com/sirupsen/logrus"
 )
 
+// targetsFile lists the demoware APIs to scrape, and is reloaded as it changes
+const targetsFile = "targets.yaml"
+
+// recordFile, if set, captures every raw batch scraped for later replay
+const recordFile = ""
+
+// replayFile, if set, replays a recording at its original speed in place of
+// scraping and push ingestion
+const replayFile = ""
+
+// deadLetterFile keeps batches and metrics that couldn't be processed, rotated
+// once it reaches deadLetterMaxBytes. See cmd/deadletters to inspect and
+// re-inject them
+const (
+	deadLetterFile     = "deadletters.jsonl"
+	deadLetterMaxBytes = 16 << 20
+)
+
+// pushAddr is where hosts that can't be polled POST their metrics, or "" to
+// disable push ingestion. Pushed batches aren't authenticated, so it only
+// listens locally unless opened up deliberately
+const pushAddr = "localhost:9090"
+
+// drainTimeout is how long to wait on shutdown for in-flight batches to make
+// it through the dispatcher and handlers before giving up on them
+const drainTimeout = 10 * time.Second
+
+// Exit statuses
+const (
+	exitOK = iota
+	exitFailed
+	exitDrainTimedOut
+	exitAborted
+)
+
+// backpressurePolicy decides how the generator reacts when the dispatcher and
+// handlers can't keep up with the poll rate
+var backpressurePolicy metrics.BackpressurePolicy = metrics.SlowDownPolicy{
+	Threshold: 0.5,
+	MaxDelay:  5 * time.Second,
+}
+
 func main() {
+	os.Exit(run())
+}
+
+// run starts the pipeline and blocks until SIGINT or SIGTERM, then shuts it
+// down gracefully, returning the process's exit status. A second signal
+// abandons the drain
+func run() int {
 	// TODO: use viper for configuration through commandline flags
 	log.SetLevel(log.DebugLevel)
-	metrics.DemowareMetricsURL = "http://localhost:8080/metrics"
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
 
-	dispatcher := metrics.ResultStreamDispatcher{}
-	defer dispatcher.Close()
+	deadLetters, err := metrics.NewDeadLetterFile(deadLetterFile, deadLetterMaxBytes)
+	if err != nil {
+		log.Error(err)
+		return exitFailed
+	}
+	sinks := []io.Closer{deadLetters}
 
-	loadMetricsHandler := &metrics.LoadMetricsHandler{}
-	cpuMetricsHandler := &metrics.CPUMetricsHandler{}
-	kernelMetricsHandler := &metrics.KernelMetricsHandler{}
-	metricSubscriptions := map[metrics.Handler]<-chan interface{}{
-		loadMetricsHandler:   dispatcher.Subscribe(metrics.LoadAverageMetric),
-		cpuMetricsHandler:    dispatcher.Subscribe(metrics.CPUUsageMetric),
-		kernelMetricsHandler: dispatcher.Subscribe(metrics.LastKernelUpgradeMetric),
+	dispatcher := &metrics.ResultStreamDispatcher{BufferSize: 64}
+	errorStream := &metrics.ErrorStream{BufferSize: 64}
+	errorEvents, _ := errorStream.Subscribe()
+	go metrics.LogErrors(errorEvents)
+	errorCounter := &metrics.ErrorCounter{}
+	countedEvents, _ := errorStream.Subscribe()
+	go errorCounter.Count(countedEvents)
+	loadMetricsHandler := &metrics.PerSourceHandler{
+		New: func() metrics.Handler { return &metrics.LoadMetricsHandler{} },
+	}
+	cpuMetricsHandler := &metrics.PerSourceHandler{
+		New: func() metrics.Handler {
+			// A resized VM starts over rather than failing every CPU metric
+			return &metrics.CPUMetricsHandler{Hotplug: metrics.NewEpochOnHotplug}
+		},
+	}
+	kernelMetricsHandler := &metrics.PerSourceHandler{
+		New: func() metrics.Handler { return &metrics.KernelMetricsHandler{} },
 	}
 
-	done := make(chan interface{})
-	defer close(done)
-	ingestedMetrics := metrics.RunGenerator(done)
-	go dispatcher.Run(done, ingestedMetrics)
-	for handler, stream := range metricSubscriptions {
-		go metrics.RunMetricStreamHandler(done, stream, handler)
+	watcher := &metrics.TargetWatcher{
+		Path: targetsFile,
+		Schedule: metrics.PollSchedule{
+			Interval: time.Second,
+			Align:    true,
+			MaxRPS:   5,
+			Buffer:   8,
+			Backpressure: &metrics.Backpressure{
+				Gauge:  dispatcher,
+				Policy: backpressurePolicy,
+			},
+		},
+		GracePeriod: 10 * time.Minute,
+		OnEvict: func(source string) {
+			loadMetricsHandler.Evict(source)
+			cpuMetricsHandler.Evict(source)
+			kernelMetricsHandler.Evict(source)
+		},
 	}
 
-introspectionLoop:
-	for {
-		select {
-		case <-done:
-			break introspectionLoop
-		case <-time.After(5 * time.Second):
-			loadStats := loadMetricsHandler.CurrentStats()
+	if recordFile != "" {
+		recorder, err := metrics.NewRecorder(recordFile)
+		if err != nil {
+			log.Error(err)
+			deadLetters.Close()
+			return exitFailed
+		}
+		sinks = append(sinks, recorder)
+		watcher.Recorder = recorder
+	}
+
+	sources := []metrics.Source{watcher}
+	// Only local clients can push, so they're trusted to name their source,
+	// as deadletters reinject does
+	pushSource := &metrics.PushSource{Addr: pushAddr, Buffer: 8, TrustSource: true}
+	if pushAddr != "" {
+		sources = append(sources, pushSource)
+	}
+	if replayFile != "" {
+		sources = []metrics.Source{&metrics.ReplaySource{Path: replayFile, Speed: 1}}
+	}
+
+	pipeline := metrics.NewPipeline(
+		metrics.WithSources(sources...),
+		metrics.WithDispatcher(dispatcher),
+		metrics.WithHandler(metrics.LoadAverageMetric, loadMetricsHandler),
+		metrics.WithHandler(metrics.CPUUsageMetric, cpuMetricsHandler),
+		metrics.WithHandler(metrics.LastKernelUpgradeMetric, kernelMetricsHandler),
+		metrics.WithDeadLetters(deadLetters),
+		metrics.WithErrors(errorStream),
+		metrics.WithSinks(sinks...),
+		metrics.WithDrainTimeout(drainTimeout),
+	)
+
+	logStats := func() {
+		for _, subStats := range dispatcher.SubscriptionStats() {
+			log.WithFields(log.Fields{
+				"subscription": subStats.Name,
+				"policy":       subStats.Policy,
+				"delivered":    subStats.Delivered,
+				"dropped":      subStats.Dropped,
+				"queue":        subStats.Queue,
+			}).Debug("Current SubscriptionStats")
+		}
+
+		errorStats := errorStream.CurrentStats()
+		log.WithFields(log.Fields{
+			"published": errorStats.Published,
+			"dropped":   errorStats.Dropped,
+		}).Debug("Current ErrorStreamStats")
+		log.WithFields(log.Fields{
+			"pipeline":                              errorCounter.Counts(),
+			string(metrics.LoadAverageMetric):       loadMetricsHandler.ErrorCounts(),
+			string(metrics.CPUUsageMetric):          cpuMetricsHandler.ErrorCounts(),
+			string(metrics.LastKernelUpgradeMetric): kernelMetricsHandler.ErrorCounts(),
+		}).Debug("Current ErrorCounts")
+
+		receiverStats := pushSource.CurrentStats()
+		log.WithFields(log.Fields{
+			"accepted_batches": receiverStats.AcceptedBatches,
+			"accepted_metrics": receiverStats.AcceptedMetrics,
+			"rejected_batches": receiverStats.RejectedBatches,
+			"rejections":       receiverStats.Rejections,
+		}).Debug("Current ReceiverStats")
+
+		for source, handler := range loadMetricsHandler.Handlers() {
+			loadStats := handler.(*metrics.LoadMetricsHandler).CurrentStats()
 			log.WithFields(log.Fields{
-				"n":   loadStats.N,
-				"min": loadStats.Min,
-				"max": loadStats.Max,
+				"source":    source,
+				"n":         loadStats.N,
+				"min":       loadStats.Min,
+				"max":       loadStats.Max,
+				"windows":   loadStats.Windows,
+				"quantiles": loadStats.Quantiles,
 			}).Debug("Current LoadStats")
+		}
 
-			cpuStats := cpuMetricsHandler.CurrentStats()
+		for source, handler := range cpuMetricsHandler.Handlers() {
+			cpuHandler := handler.(*metrics.CPUMetricsHandler)
+			cpuStats := cpuHandler.CurrentStats()
 			log.WithFields(log.Fields{
-				"n":        cpuStats.N,
-				"averages": cpuStats.Averages,
+				"source":    source,
+				"epochs":    len(cpuHandler.Epochs()),
+				"n":         cpuStats.N,
+				"averages":  cpuStats.Averages,
+				"ewmas":     cpuStats.EWMAs,
+				"stddevs":   cpuStats.StdDevs,
+				"mins":      cpuStats.Mins,
+				"maxes":     cpuStats.Maxes,
+				"summary":   cpuStats.Overall,
+				"quantiles": cpuStats.Quantiles,
+				"overall":   cpuStats.OverallQuantiles,
 			}).Debug("Current CPUUsageStats")
+		}
 
-			kernelStats := kernelMetricsHandler.CurrentStats()
+		for source, handler := range kernelMetricsHandler.Handlers() {
+			kernelStats := handler.(*metrics.KernelMetricsHandler).CurrentStats()
 			log.WithFields(log.Fields{
+				"source":      source,
 				"n":           kernelStats.N,
 				"most_recent": kernelStats.MostRecent,
 			}).Debug("Current KernelUpgradeStats")
 		}
 	}
+
+	// Stopping the pipeline lets it drain, while cancelling ctx aborts every
+	// stage immediately, in-flight requests included
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	errs := make(chan error, 1)
+	go func() { errs <- pipeline.Run(ctx) }()
+
+	stopping := false
+	for {
+		select {
+		case sig := <-signals:
+			if stopping {
+				log.WithField("signal", sig).Error("Interrupted while draining pipeline, dropping in-flight metrics")
+				cancel()
+				continue
+			}
+			log.WithField("signal", sig).Info("Shutting down, draining pipeline")
+			pipeline.Stop()
+			stopping = true
+		case err := <-errs:
+			logStats()
+			switch {
+			case err == nil:
+				log.Info("Pipeline drained")
+				return exitOK
+			case errors.Is(err, metrics.ErrDrainTimeout):
+				log.WithField("timeout", drainTimeout).Error("Timed out draining pipeline, dropping in-flight metrics")
+				return exitDrainTimedOut
+			case errors.Is(err, context.Canceled):
+				return exitAborted
+			default:
+				log.Error(err)
+				return exitFailed
+			}
+		case <-time.After(5 * time.Second):
+			logStats()
+		}
+	}
 }
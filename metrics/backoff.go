@@ -0,0 +1,190 @@
+package metrics
+
+import (
+	"errors"
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ErrCircuitOpen is returned in place of an API call while the circuit breaker
+// is refusing requests
+var ErrCircuitOpen = errors.New("circuit breaker open: skipping request")
+
+// Backoff computes exponentially increasing delays between retries, randomized
+// by Jitter so that many consumers don't retry in lockstep
+type Backoff struct {
+	Initial    time.Duration
+	Max        time.Duration
+	Multiplier float64
+	// Jitter is the fraction (0 to 1) of each delay that may be randomly shaved off
+	Jitter float64
+}
+
+// DefaultBackoff is the Backoff used by RunGenerator on retryable failures
+var DefaultBackoff = Backoff{
+	Initial:    100 * time.Millisecond,
+	Max:        30 * time.Second,
+	Multiplier: 2,
+	Jitter:     0.5,
+}
+
+// Duration returns the delay before the given retry attempt, starting at 1
+func (b Backoff) Duration(attempt int) time.Duration {
+	if attempt < 1 {
+		return 0
+	}
+	d := float64(b.Initial) * math.Pow(b.Multiplier, float64(attempt-1))
+	if max := float64(b.Max); 0 < max && max < d {
+		d = max
+	}
+	if 0 < b.Jitter {
+		d -= d * b.Jitter * rand.Float64()
+	}
+	return time.Duration(d)
+}
+
+// BreakerState is the state of a CircuitBreaker
+type BreakerState int
+
+const (
+	// BreakerClosed lets every request through
+	BreakerClosed BreakerState = iota
+	// BreakerOpen refuses requests until the cooldown has elapsed
+	BreakerOpen
+	// BreakerHalfOpen lets a single probe request through to test the source
+	BreakerHalfOpen
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	}
+	return "unknown"
+}
+
+// CircuitBreaker stops calls to a failing source after FailureThreshold
+// consecutive failures, then periodically lets a probe through to check
+// whether the source has recovered
+type CircuitBreaker struct {
+	mu               sync.Mutex
+	FailureThreshold int
+	Cooldown         time.Duration
+	state            BreakerState
+	failures         int
+	openedAt         time.Time
+	probing          bool
+	now              func() time.Time
+}
+
+// DefaultBreakerThreshold and DefaultBreakerCooldown configure the
+// CircuitBreaker used by RunGenerator
+var (
+	DefaultBreakerThreshold = 5
+	DefaultBreakerCooldown  = 30 * time.Second
+)
+
+// NewCircuitBreaker returns a closed CircuitBreaker
+func NewCircuitBreaker(threshold int, cooldown time.Duration) *CircuitBreaker {
+	return &CircuitBreaker{
+		FailureThreshold: threshold,
+		Cooldown:         cooldown,
+		now:              time.Now,
+	}
+}
+
+// State returns the current state of the breaker, moving from open to
+// half-open if the cooldown has elapsed
+func (b *CircuitBreaker) State() BreakerState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.refresh()
+	return b.state
+}
+
+// Allow reports whether a request may be made right now
+func (b *CircuitBreaker) Allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.refresh()
+	switch b.state {
+	case BreakerOpen:
+		return false
+	case BreakerHalfOpen:
+		if b.probing {
+			return false
+		}
+		b.probing = true
+	}
+	return true
+}
+
+// Remaining returns how long until the breaker will let a probe through
+func (b *CircuitBreaker) Remaining() time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.refresh()
+	if b.state != BreakerOpen {
+		return 0
+	}
+	remaining := b.openedAt.Add(b.Cooldown).Sub(b.now())
+	if remaining < 0 {
+		return 0
+	}
+	return remaining
+}
+
+// Success records a successful request, closing the breaker
+func (b *CircuitBreaker) Success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state != BreakerClosed {
+		log.WithField("from", b.state).Info("Circuit breaker closed")
+	}
+	b.state = BreakerClosed
+	b.failures = 0
+	b.probing = false
+}
+
+// Failure records a failed request, opening the breaker if the threshold has
+// been reached or if the failed request was a half-open probe
+func (b *CircuitBreaker) Failure() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures++
+	b.probing = false
+	if b.state == BreakerHalfOpen || (b.state == BreakerClosed && b.FailureThreshold <= b.failures) {
+		log.WithFields(log.Fields{
+			"from":     b.state,
+			"failures": b.failures,
+			"cooldown": b.Cooldown,
+		}).Warn("Circuit breaker opened")
+		b.state = BreakerOpen
+		b.openedAt = b.now()
+	}
+}
+
+// refresh moves an open breaker to half-open once its cooldown has elapsed.
+// Callers must hold b.mu
+func (b *CircuitBreaker) refresh() {
+	if b.now == nil {
+		b.now = time.Now
+	}
+	if b.state == BreakerOpen && !b.now().Before(b.openedAt.Add(b.Cooldown)) {
+		b.state = BreakerHalfOpen
+		b.probing = false
+	}
+}
@@ -0,0 +1,181 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestBackoff_Duration(t *testing.T) {
+	backoff := Backoff{Initial: 100 * time.Millisecond, Max: time.Second, Multiplier: 2}
+	testCases := []struct {
+		Attempt  int
+		Expected time.Duration
+	}{
+		{0, 0},
+		{1, 100 * time.Millisecond},
+		{2, 200 * time.Millisecond},
+		{4, 800 * time.Millisecond},
+		{5, time.Second},
+		{50, time.Second},
+	}
+	for _, testCase := range testCases {
+		t.Run(fmt.Sprintf("Attempt%v", testCase.Attempt), func(t *testing.T) {
+			observed := backoff.Duration(testCase.Attempt)
+			if observed != testCase.Expected {
+				t.Errorf("unexpected duration: %v != %v (observed, expected)", observed, testCase.Expected)
+			}
+		})
+	}
+
+	t.Run("Jitter", func(t *testing.T) {
+		backoff.Jitter = 0.5
+		for i := 0; i < 100; i++ {
+			observed := backoff.Duration(3)
+			if observed < 200*time.Millisecond || 400*time.Millisecond < observed {
+				t.Fatalf("jittered duration out of bounds: %v", observed)
+			}
+		}
+	})
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	now := time.Now()
+	breaker := NewCircuitBreaker(3, time.Minute)
+	breaker.now = func() time.Time { return now }
+
+	for i := 0; i < 2; i++ {
+		breaker.Failure()
+	}
+	if state := breaker.State(); state != BreakerClosed {
+		t.Fatalf("unexpected state below threshold: %v", state)
+	}
+	breaker.Failure()
+	if state := breaker.State(); state != BreakerOpen {
+		t.Fatalf("unexpected state at threshold: %v", state)
+	}
+	if breaker.Allow() {
+		t.Fatal("open breaker allowed a request")
+	}
+	if remaining := breaker.Remaining(); remaining != time.Minute {
+		t.Errorf("unexpected remaining cooldown: %v != %v (observed, expected)", remaining, time.Minute)
+	}
+
+	now = now.Add(time.Minute)
+	if state := breaker.State(); state != BreakerHalfOpen {
+		t.Fatalf("unexpected state after cooldown: %v", state)
+	}
+	if !breaker.Allow() {
+		t.Fatal("half-open breaker refused the probe")
+	}
+	if breaker.Allow() {
+		t.Fatal("half-open breaker allowed a second concurrent probe")
+	}
+	breaker.Failure()
+	if state := breaker.State(); state != BreakerOpen {
+		t.Fatalf("failed probe should reopen the breaker, got %v", state)
+	}
+
+	now = now.Add(time.Minute)
+	if !breaker.Allow() {
+		t.Fatal("half-open breaker refused the probe")
+	}
+	breaker.Success()
+	if state := breaker.State(); state != BreakerClosed {
+		t.Fatalf("successful probe should close the breaker, got %v", state)
+	}
+}
+
+func TestIngest_ErrorClassification(t *testing.T) {
+	testCases := []struct {
+		Name              string
+		Status            int
+		Body              string
+		ExpectedRetryable bool
+	}{
+		{"ServerError", http.StatusInternalServerError, "", true},
+		{"TooManyRequests", http.StatusTooManyRequests, "", true},
+		{"NotFound", http.StatusNotFound, "", false},
+		{"MalformedJSON", http.StatusOK, "{not json", false},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.Name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(testCase.Status)
+				fmt.Fprint(w, testCase.Body)
+			}))
+			defer server.Close()
+
+			result := Target{URL: server.URL}.fetch(context.Background(), 0)
+			if result.Error == nil {
+				t.Fatal("expected error in fetch(), got none")
+			}
+			if IsRetryable(result.Error) != testCase.ExpectedRetryable {
+				t.Errorf("unexpected retryable classification for %v: %v", result.Error, !testCase.ExpectedRetryable)
+			}
+		})
+	}
+
+	t.Run("ConnectionRefused", func(t *testing.T) {
+		server := httptest.NewServer(http.NotFoundHandler())
+		target := Target{URL: server.URL}
+		server.Close()
+
+		result := target.fetch(context.Background(), 0)
+		if !IsRetryable(result.Error) {
+			t.Errorf("expected connection error to be retryable: %v", result.Error)
+		}
+	})
+}
+
+func TestRunTargetGenerator_BacksOffNonRetryable(t *testing.T) {
+	var requests int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&requests, 1)
+		http.NotFound(w, r)
+	}))
+	defer server.Close()
+
+	done := make(chan interface{})
+	resultStream := RunTargetGenerator(done, Target{URL: server.URL}, PollSchedule{})
+	timeout := time.After(300 * time.Millisecond)
+	for draining := true; draining; {
+		select {
+		case <-resultStream:
+		case <-timeout:
+			draining = false
+		}
+	}
+	close(done)
+
+	// Backing off from 100ms, less up to half for jitter, leaves room for 3
+	if observed := atomic.LoadInt64(&requests); 5 < observed {
+		t.Errorf("unexpected number of requests to a 404 target in 300ms: %v, expected at most 5", observed)
+	}
+}
+
+func TestIngestGuard_CircuitOpenLabelled(t *testing.T) {
+	guard := newIngestGuard(func(ctx context.Context) Result {
+		t.Fatal("unexpected call through an open breaker")
+		return Result{}
+	})
+	for i := 0; i < guard.breaker.FailureThreshold; i++ {
+		guard.breaker.Failure()
+	}
+
+	result := Target{Name: "web-1"}.labelled(context.Background(), guard.call)
+	if !errors.Is(result.Error, ErrCircuitOpen) {
+		t.Fatalf("unexpected error: %v != %v (observed, expected)", result.Error, ErrCircuitOpen)
+	}
+	if result.Source != "web-1" || SourceFromContext(result.Context()) != "web-1" {
+		t.Errorf("unexpected source of refused call: %q and %q, expected web-1", result.Source, SourceFromContext(result.Context()))
+	}
+	if TraceID(result.Context()) == "" {
+		t.Error("expected refused call to carry a trace ID")
+	}
+}
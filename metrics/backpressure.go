@@ -0,0 +1,147 @@
+package metrics
+
+import (
+	"context"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// SaturationGauge reports how full a stage's queue is, from 0 (empty) to 1
+// (full, so the producer feeding it will block)
+type SaturationGauge interface {
+	Saturation() float64
+}
+
+// SaturationFunc adapts a function to the SaturationGauge interface
+type SaturationFunc func() float64
+
+// Saturation calls f()
+func (f SaturationFunc) Saturation() float64 {
+	return f()
+}
+
+// QueueDepth is a snapshot of how many items are waiting in a buffered channel
+type QueueDepth struct {
+	Len int
+	Cap int
+}
+
+// Saturation returns Len as a fraction of Cap. Unbuffered queues always report
+// 0 since they have no depth to measure
+func (q QueueDepth) Saturation() float64 {
+	if q.Cap == 0 {
+		return 0
+	}
+	return float64(q.Len) / float64(q.Cap)
+}
+
+// ResultStreamSaturation returns a gauge of how full the given stream is
+func ResultStreamSaturation(stream <-chan Result) SaturationGauge {
+	return SaturationFunc(func() float64 {
+		return QueueDepth{Len: len(stream), Cap: cap(stream)}.Saturation()
+	})
+}
+
+// MaxSaturation combines gauges, reporting the most saturated of them
+func MaxSaturation(gauges ...SaturationGauge) SaturationGauge {
+	return SaturationFunc(func() float64 {
+		max := 0.0
+		for _, gauge := range gauges {
+			if s := gauge.Saturation(); max < s {
+				max = s
+			}
+		}
+		return max
+	})
+}
+
+// BackpressurePolicy decides how a generator reacts to downstream saturation
+type BackpressurePolicy interface {
+	// Throttle returns how long to hold off the next poll at the given
+	// saturation, and whether to check the saturation again after waiting
+	// rather than polling
+	Throttle(saturation float64) (wait time.Duration, recheck bool)
+}
+
+// NoBackpressure polls on schedule regardless of downstream saturation,
+// relying on blocking channel sends alone
+type NoBackpressure struct{}
+
+// Throttle never holds off
+func (NoBackpressure) Throttle(saturation float64) (time.Duration, bool) {
+	return 0, false
+}
+
+// SlowDownPolicy delays each poll once saturation passes Threshold, scaling
+// linearly up to MaxDelay when downstream is full
+type SlowDownPolicy struct {
+	Threshold float64
+	MaxDelay  time.Duration
+}
+
+// Throttle returns a delay proportional to how far past Threshold we are
+func (p SlowDownPolicy) Throttle(saturation float64) (time.Duration, bool) {
+	if saturation <= p.Threshold || 1 <= p.Threshold {
+		return 0, false
+	}
+	scale := (saturation - p.Threshold) / (1 - p.Threshold)
+	if 1 < scale {
+		scale = 1
+	}
+	return time.Duration(scale * float64(p.MaxDelay)), false
+}
+
+// SkipPolicy skips polls entirely while saturation is at or above Threshold,
+// checking again every Recheck
+type SkipPolicy struct {
+	Threshold float64
+	Recheck   time.Duration
+}
+
+// Throttle holds off for Recheck while saturated
+func (p SkipPolicy) Throttle(saturation float64) (time.Duration, bool) {
+	if saturation < p.Threshold {
+		return 0, false
+	}
+	return p.Recheck, true
+}
+
+// Backpressure pairs a gauge of downstream saturation with the policy used to
+// react to it
+type Backpressure struct {
+	Gauge  SaturationGauge
+	Policy BackpressurePolicy
+}
+
+// wait blocks for as long as the policy says to hold off, returning false if
+// ctx is cancelled while waiting
+func (b *Backpressure) wait(ctx context.Context, gauges ...SaturationGauge) bool {
+	gauges = append(gauges, b.Gauge)
+	nonNil := make([]SaturationGauge, 0, len(gauges))
+	for _, g := range gauges {
+		if g != nil {
+			nonNil = append(nonNil, g)
+		}
+	}
+	gauge := MaxSaturation(nonNil...)
+	for {
+		saturation := gauge.Saturation()
+		d, recheck := b.Policy.Throttle(saturation)
+		if recheck {
+			log.WithField("saturation", saturation).Debug("Downstream saturated, skipping poll")
+		}
+		if 0 < d {
+			timer := time.NewTimer(d)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return false
+			case <-timer.C:
+			}
+		}
+		if !recheck || d <= 0 {
+			return true
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package metrics
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestSlowDownPolicy_Throttle(t *testing.T) {
+	policy := SlowDownPolicy{Threshold: 0.5, MaxDelay: time.Second}
+	testCases := []struct {
+		Saturation float64
+		Expected   time.Duration
+	}{
+		{0, 0},
+		{0.5, 0},
+		{0.75, 500 * time.Millisecond},
+		{1, time.Second},
+	}
+	for _, testCase := range testCases {
+		t.Run(fmt.Sprintf("Saturation%v", testCase.Saturation), func(t *testing.T) {
+			wait, recheck := policy.Throttle(testCase.Saturation)
+			if wait != testCase.Expected {
+				t.Errorf("unexpected wait: %v != %v (observed, expected)", wait, testCase.Expected)
+			}
+			if recheck {
+				t.Errorf("SlowDownPolicy should never recheck")
+			}
+		})
+	}
+}
+
+func TestBackpressure_WaitSkipsWhileSaturated(t *testing.T) {
+	saturation := 1.0
+	checks := 0
+	bp := &Backpressure{
+		Gauge: SaturationFunc(func() float64 {
+			checks++
+			if checks == 3 {
+				saturation = 0
+			}
+			return saturation
+		}),
+		Policy: SkipPolicy{Threshold: 0.9, Recheck: time.Millisecond},
+	}
+	if !bp.wait(context.Background()) {
+		t.Fatal("unexpected stop while waiting")
+	}
+	if checks != 3 {
+		t.Errorf("unexpected saturation checks: %v != 3 (observed, expected)", checks)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	saturation, checks = 1, -100
+	if bp.wait(ctx) {
+		t.Error("expected wait to stop when ctx is cancelled")
+	}
+}
+
+func TestMaxSaturation(t *testing.T) {
+	stream := make(chan Result, 4)
+	stream <- Result{}
+	stream <- Result{}
+	gauge := MaxSaturation(ResultStreamSaturation(stream), SaturationFunc(func() float64 { return 0.25 }))
+	if s := gauge.Saturation(); s != 0.5 {
+		t.Errorf("unexpected saturation: %v != 0.5 (observed, expected)", s)
+	}
+}
@@ -0,0 +1,63 @@
+package metrics
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+)
+
+// TraceHeader carries a batch's trace ID on requests to demoware APIs and on
+// batches pushed to a Receiver
+const TraceHeader = "X-Demoware-Trace-Id"
+
+type contextKey int
+
+const (
+	traceIDKey contextKey = iota
+	sourceKey
+)
+
+// WithTraceID returns a copy of ctx carrying the given trace ID
+func WithTraceID(ctx context.Context, traceID string) context.Context {
+	return context.WithValue(ctx, traceIDKey, traceID)
+}
+
+// TraceID returns the trace ID carried by ctx, or "" if it has none
+func TraceID(ctx context.Context) string {
+	traceID, _ := ctx.Value(traceIDKey).(string)
+	return traceID
+}
+
+// NewTraceID returns a random 128-bit trace ID, hex encoded
+func NewTraceID() string {
+	id := make([]byte, 16)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// WithSource returns a copy of ctx carrying the given source label
+func WithSource(ctx context.Context, source string) context.Context {
+	return context.WithValue(ctx, sourceKey, source)
+}
+
+// SourceFromContext returns the source label carried by ctx, or "" if it has
+// none
+func SourceFromContext(ctx context.Context) string {
+	source, _ := ctx.Value(sourceKey).(string)
+	return source
+}
+
+// contextOf returns a context that's cancelled once done is closed, for the
+// done-based variants of context-aware stages. Its goroutine lingers until done
+// is closed, so those variants are best avoided where done may never be
+func contextOf(done <-chan interface{}) context.Context {
+	if done == nil {
+		return context.Background()
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		defer cancel()
+		<-done
+	}()
+	return ctx
+}
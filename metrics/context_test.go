@@ -0,0 +1,105 @@
+package metrics
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTarget_LabelledPropagatesTrace(t *testing.T) {
+	traceIDs := make(chan string, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceIDs <- r.Header.Get(TraceHeader)
+		w.Write([]byte(`[]`))
+	}))
+	defer server.Close()
+
+	target := Target{Name: "web-1", URL: server.URL}
+	fetch := func(ctx context.Context) Result { return target.fetch(ctx, 0) }
+	result := target.labelled(WithTraceID(context.Background(), "abc123"), fetch)
+	if result.Error != nil {
+		t.Fatalf("unexpected error in labelled(): %v", result.Error)
+	}
+	if observed := <-traceIDs; observed != "abc123" {
+		t.Errorf("unexpected trace header: %v != abc123 (observed, expected)", observed)
+	}
+	if observed := TraceID(result.Context()); observed != "abc123" {
+		t.Errorf("unexpected result trace ID: %v != abc123 (observed, expected)", observed)
+	}
+	if observed := SourceFromContext(result.Context()); observed != "web-1" {
+		t.Errorf("unexpected result source: %v != web-1 (observed, expected)", observed)
+	}
+
+	// Batches without a trace ID get a fresh one
+	target = Target{URL: server.URL}
+	result = target.labelled(context.Background(), fetch)
+	if observed := <-traceIDs; observed == "" || observed != TraceID(result.Context()) {
+		t.Errorf("unexpected generated trace ID: %q != %q (observed, expected)", observed, TraceID(result.Context()))
+	}
+}
+
+func TestTarget_FetchAborted(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+	target := Target{URL: server.URL}
+
+	t.Run("Cancelled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		time.AfterFunc(10*time.Millisecond, cancel)
+		result := target.fetch(ctx, 0)
+		if !IsRetryable(result.Error) {
+			t.Errorf("expected cancelled request to fail as retryable: %v", result.Error)
+		}
+	})
+	t.Run("TimedOut", func(t *testing.T) {
+		result := target.fetch(context.Background(), 10*time.Millisecond)
+		if !IsRetryable(result.Error) {
+			t.Errorf("expected timed out request to fail as retryable: %v", result.Error)
+		}
+	})
+}
+
+func TestRunTargetGeneratorContext_Cancel(t *testing.T) {
+	requested := make(chan struct{}, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requested <- struct{}{}
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	resultStream := RunTargetGeneratorContext(ctx, Target{URL: server.URL}, PollSchedule{})
+	<-requested
+	cancel()
+	select {
+	case _, ok := <-resultStream:
+		if ok {
+			t.Error("expected no results once cancelled")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("generator still running after its context was cancelled")
+	}
+}
+
+func TestReceiver_TraceHeader(t *testing.T) {
+	done := make(chan interface{})
+	defer close(done)
+	receiver := NewReceiver(done, 1)
+
+	req := httptest.NewRequest(http.MethodPost, "/metrics", strings.NewReader(`[]`))
+	req.Header.Set(TraceHeader, "abc123")
+	w := httptest.NewRecorder()
+	receiver.ServeHTTP(w, req)
+	if observed := w.Header().Get(TraceHeader); observed != "abc123" {
+		t.Errorf("unexpected trace header: %v != abc123 (observed, expected)", observed)
+	}
+	result := <-receiver.Results()
+	if observed := TraceID(result.Context()); observed != "abc123" {
+		t.Errorf("unexpected result trace ID: %v != abc123 (observed, expected)", observed)
+	}
+}
@@ -0,0 +1,224 @@
+package metrics
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Stages at which a metric or batch can fail, and so end up as an ErrorEvent
+// or a dead letter. Only batches that were received can be dead letters
+const (
+	IngestStage   = "ingest"
+	DecodeStage   = "decode"
+	DispatchStage = "dispatch"
+	HandleStage   = "handle"
+)
+
+// DeadLetter is a batch or metric that couldn't be processed, kept with the
+// reason so that it can be inspected and re-injected after a fix
+type DeadLetter struct {
+	Time   time.Time  `json:"time"`
+	Stage  string     `json:"stage"`
+	Reason string     `json:"reason"`
+	Source string     `json:"source,omitempty"`
+	Type   MetricType `json:"type,omitempty"`
+	// Payload holds the raw batch (decode stage) or metric (later stages) if
+	// it was valid JSON, otherwise Raw holds it verbatim
+	Payload json.RawMessage `json:"payload,omitempty"`
+	Raw     string          `json:"raw,omitempty"`
+}
+
+// newDeadLetter builds a DeadLetter around the given raw payload
+func newDeadLetter(stage string, reason error, source string, t MetricType, data []byte) DeadLetter {
+	letter := DeadLetter{
+		Time:   time.Now(),
+		Stage:  stage,
+		Reason: reason.Error(),
+		Source: source,
+		Type:   t,
+	}
+	if json.Valid(data) {
+		letter.Payload = append(json.RawMessage{}, data...)
+	} else {
+		letter.Raw = string(data)
+	}
+	return letter
+}
+
+// metricDeadLetter builds a DeadLetter for a single decoded metric
+func metricDeadLetter(stage string, reason error, metric Metric) DeadLetter {
+	data, err := json.Marshal(metric)
+	if err != nil {
+		data = []byte(fmt.Sprintf("%v", metric.Payload.Value))
+	}
+	return newDeadLetter(stage, reason, metric.Source, metric.Type, data)
+}
+
+// Batch returns the dead letter as a metrics batch in the demoware API's JSON
+// shape, ready to be re-injected
+func (l DeadLetter) Batch() []byte {
+	data := []byte(l.Raw)
+	if l.Payload != nil {
+		data = l.Payload
+	}
+	if l.Stage == DecodeStage {
+		return data
+	}
+	return append(append([]byte("["), data...), ']')
+}
+
+// DeadLetterSink receives dead letters
+type DeadLetterSink interface {
+	Send(letter DeadLetter) error
+}
+
+// sendDeadLetter sends to sink if there is one, logging any failure
+func sendDeadLetter(sink DeadLetterSink, letter DeadLetter) {
+	if sink == nil {
+		return
+	}
+	if err := sink.Send(letter); err != nil {
+		log.WithField("stage", letter.Stage).Errorf("unable to send dead letter: %v", err)
+	}
+}
+
+// DeadLetterFile is a DeadLetterSink appending to a JSONL file. Once the file
+// grows past MaxBytes it's rotated to Path + ".1", replacing the previous
+// rotation, so at most about twice MaxBytes is kept on disk
+type DeadLetterFile struct {
+	mu       sync.Mutex
+	Path     string
+	MaxBytes int64
+	file     *os.File
+	size     int64
+}
+
+// NewDeadLetterFile opens the dead letter file at path for appending
+func NewDeadLetterFile(path string, maxBytes int64) (*DeadLetterFile, error) {
+	f := &DeadLetterFile{Path: path, MaxBytes: maxBytes}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *DeadLetterFile) open() error {
+	file, err := os.OpenFile(f.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file, f.size = file, info.Size()
+	return nil
+}
+
+// Send appends the letter to the file, rotating it first if it's full
+func (f *DeadLetterFile) Send(letter DeadLetter) error {
+	data, err := json.Marshal(letter)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if 0 < f.MaxBytes && 0 < f.size && f.MaxBytes < f.size+int64(len(data)) {
+		if err := f.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := f.file.Write(data)
+	f.size += int64(n)
+	return err
+}
+
+// rotate moves the current file aside and starts a new one. Callers must
+// hold f.mu
+func (f *DeadLetterFile) rotate() error {
+	if err := f.file.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(f.Path, f.Path+".1"); err != nil {
+		return err
+	}
+	return f.open()
+}
+
+// Close flushes and closes the dead letter file
+func (f *DeadLetterFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.file.Sync(); err != nil {
+		f.file.Close()
+		return err
+	}
+	return f.file.Close()
+}
+
+// ReadDeadLetters reads every dead letter kept at path, oldest first,
+// including those in its rotated file
+func ReadDeadLetters(path string) ([]DeadLetter, error) {
+	letters := make([]DeadLetter, 0)
+	for _, p := range []string{path + ".1", path} {
+		file, err := os.Open(p)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		scanner := bufio.NewScanner(file)
+		scanner.Buffer(make([]byte, 64*1024), 2*DefaultMaxBodyBytes)
+		for scanner.Scan() {
+			var letter DeadLetter
+			if err := json.Unmarshal(scanner.Bytes(), &letter); err != nil {
+				file.Close()
+				return nil, fmt.Errorf("unable to parse dead letter in %v: %v", p, err)
+			}
+			letters = append(letters, letter)
+		}
+		err = scanner.Err()
+		file.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return letters, nil
+}
+
+// DeadLetterHandler wraps a Handler, sending every metric it fails to handle
+// to Sink before returning the error as usual
+type DeadLetterHandler struct {
+	Handler Handler
+	Type    MetricType
+	Sink    DeadLetterSink
+}
+
+// Handle passes the metric to the wrapped Handler
+func (h *DeadLetterHandler) Handle(metric interface{}) error {
+	return h.HandleFrom("", metric)
+}
+
+// HandleFrom passes the metric to the wrapped Handler, along with its source
+// if the wrapped Handler wants it
+func (h *DeadLetterHandler) HandleFrom(source string, metric interface{}) error {
+	m := Metric{Type: h.Type, Payload: MetricPayload{Value: metric}, Source: source}
+	err := handleMetric(h.Handler, m)
+	if err != nil {
+		sendDeadLetter(h.Sink, metricDeadLetter(HandleStage, err, m))
+	}
+	return err
+}
@@ -0,0 +1,205 @@
+package metrics
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
+)
+
+// LoadTargets reads a list of targets from a JSON or YAML file, chosen by the
+// file's extension
+func LoadTargets(path string) ([]Target, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return parseTargets(path, data)
+}
+
+func parseTargets(path string, data []byte) ([]Target, error) {
+	targets := make([]Target, 0)
+	var err error
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &targets)
+	default:
+		err = json.Unmarshal(data, &targets)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse targets file %v: %v", path, err)
+	}
+
+	seen := make(map[string]bool, len(targets))
+	for _, target := range targets {
+		if target.URL == "" {
+			return nil, fmt.Errorf("target %q in %v has no url", target.Name, path)
+		}
+		if seen[target.Label()] {
+			return nil, fmt.Errorf("duplicate target %q in %v", target.Label(), path)
+		}
+		seen[target.Label()] = true
+	}
+	return targets, nil
+}
+
+// TargetWatcher scrapes the targets listed in a file, re-reading it every
+// Interval so that adding or removing a target starts or stops its generator
+// without a restart
+type TargetWatcher struct {
+	lifecycle
+	Path string
+	// Interval is how often to check the file for changes (default 5s)
+	Interval time.Duration
+	// Schedule is shared by every target's generator
+	Schedule PollSchedule
+	// GracePeriod is how long a removed target's stats are kept before
+	// OnEvict is called for it. Re-adding the target within the grace period
+	// cancels the eviction
+	GracePeriod time.Duration
+	OnEvict     func(source string)
+	// Recorder, if set, captures every raw batch scraped from any target
+	Recorder *Recorder
+}
+
+// Start begins watching the targets file, making TargetWatcher a Source
+func (w *TargetWatcher) Start(ctx context.Context) (<-chan Result, error) {
+	return w.run(ctx, w.start(ctx))
+}
+
+// runningTarget is a target with a generator currently scraping it
+type runningTarget struct {
+	target Target
+	stop   context.CancelFunc
+}
+
+// Run loads the targets file and returns a stream of Results from every
+// target in it, until told to stop. An error is returned if the initial load
+// fails; later failures are logged and the current targets kept
+func (w *TargetWatcher) Run(done <-chan interface{}) (<-chan Result, error) {
+	return w.RunContext(contextOf(done))
+}
+
+// RunContext is like Run, but stops once ctx is cancelled. Every target is
+// scraped under ctx, so its Results carry ctx's values
+func (w *TargetWatcher) RunContext(ctx context.Context) (<-chan Result, error) {
+	return w.run(ctx, ctx)
+}
+
+// run is like RunContext, but only stops watching and scraping once stop is
+// cancelled, closing the stream after the Results already scraped are read
+func (w *TargetWatcher) run(ctx, stop context.Context) (<-chan Result, error) {
+	data, err := ioutil.ReadFile(w.Path)
+	if err != nil {
+		return nil, err
+	}
+	targets, err := parseTargets(w.Path, data)
+	if err != nil {
+		return nil, err
+	}
+	interval := w.Interval
+	if interval <= 0 {
+		interval = 5 * time.Second
+	}
+
+	var wg sync.WaitGroup
+	resultStream := make(chan Result)
+	running := make(map[string]runningTarget)
+	removed := make(map[string]time.Time)
+
+	startTarget := func(target Target) {
+		targetStop, stopTarget := context.WithCancel(stop)
+		running[target.Label()] = runningTarget{target: target, stop: stopTarget}
+		delete(removed, target.Label())
+		log.WithFields(log.Fields{"source": target.Label(), "url": target.URL}).Info("Started scraping target")
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for result := range runTargetGenerator(ctx, targetStop, target, w.Schedule) {
+				select {
+				case <-ctx.Done():
+					return
+				case resultStream <- result:
+				}
+			}
+		}()
+	}
+	stopTarget := func(label string) {
+		running[label].stop()
+		delete(running, label)
+		removed[label] = time.Now().Add(w.GracePeriod)
+		log.WithField("source", label).Info("Stopped scraping target")
+	}
+	reconcile := func(targets []Target) {
+		wanted := make(map[string]Target, len(targets))
+		for _, target := range targets {
+			target.Recorder = w.Recorder
+			wanted[target.Label()] = target
+		}
+		for label, r := range running {
+			if target, ok := wanted[label]; ok == false || target != r.target {
+				stopTarget(label)
+			}
+		}
+		for label, target := range wanted {
+			if _, ok := running[label]; ok == false {
+				startTarget(target)
+			}
+		}
+	}
+	evictExpired := func(now time.Time) {
+		for label, deadline := range removed {
+			if now.Before(deadline) {
+				continue
+			}
+			delete(removed, label)
+			log.WithField("source", label).Info("Evicted stats for removed target")
+			if w.OnEvict != nil {
+				w.OnEvict(label)
+			}
+		}
+	}
+
+	reconcile(targets)
+	go func() {
+		defer func() {
+			for label := range running {
+				running[label].stop()
+			}
+			wg.Wait()
+			close(resultStream)
+		}()
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop.Done():
+				return
+			case now := <-ticker.C:
+				if newData, err := ioutil.ReadFile(w.Path); err != nil {
+					log.WithField("path", w.Path).Error(err)
+				} else if !bytes.Equal(newData, data) {
+					data = newData
+					if targets, err := parseTargets(w.Path, data); err != nil {
+						log.Error(err)
+					} else {
+						log.WithField("path", w.Path).Info("Reloaded targets file")
+						reconcile(targets)
+					}
+				}
+				evictExpired(now)
+			}
+		}
+	}()
+	return resultStream, nil
+}
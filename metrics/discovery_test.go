@@ -0,0 +1,121 @@
+package metrics
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseTargets(t *testing.T) {
+	expected := []Target{{Name: "a", URL: "http://a/metrics"}, {URL: "http://b/metrics"}}
+	testCases := []struct {
+		Path string
+		Data string
+	}{
+		{"targets.json", `[{"name": "a", "url": "http://a/metrics"}, {"url": "http://b/metrics"}]`},
+		{"targets.yaml", "- name: a\n  url: http://a/metrics\n- url: http://b/metrics\n"},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.Path, func(t *testing.T) {
+			targets, err := parseTargets(testCase.Path, []byte(testCase.Data))
+			if err != nil {
+				t.Fatalf("unexpected error in parseTargets(): %v", err)
+			}
+			if !reflect.DeepEqual(targets, expected) {
+				t.Errorf("unexpected targets: %v != %v (observed, expected)", targets, expected)
+			}
+		})
+	}
+
+	// Special bad cases
+	badCases := map[string]string{
+		"MissingURL": `[{"name": "a"}]`,
+		"Duplicate":  `[{"name": "a", "url": "http://a"}, {"name": "a", "url": "http://b"}]`,
+		"Malformed":  `[{"name": `,
+	}
+	for name, data := range badCases {
+		t.Run(name, func(t *testing.T) {
+			if _, err := parseTargets("targets.json", []byte(data)); err == nil {
+				t.Fatal("expected error in parseTargets(), got none")
+			}
+		})
+	}
+}
+
+func TestTargetWatcher_Reload(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `[{"type": "load_avg", "payload": {"value": 0.5}}]`)
+	}))
+	defer server.Close()
+
+	path := filepath.Join(t.TempDir(), "targets.json")
+	writeTargets := func(names ...string) {
+		targets := "["
+		for i, name := range names {
+			if 0 < i {
+				targets += ","
+			}
+			targets += fmt.Sprintf(`{"name": %q, "url": %q}`, name, server.URL)
+		}
+		if err := ioutil.WriteFile(path, []byte(targets+"]"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitForSource := func(resultStream <-chan Result, source string) {
+		timeout := time.After(5 * time.Second)
+		for {
+			select {
+			case result := <-resultStream:
+				if result.Source == source {
+					return
+				}
+			case <-timeout:
+				t.Fatalf("timed out waiting for results from %v", source)
+			}
+		}
+	}
+
+	writeTargets("a")
+	evicted := make(chan string, 1)
+	watcher := &TargetWatcher{
+		Path:        path,
+		Interval:    10 * time.Millisecond,
+		Schedule:    PollSchedule{Interval: time.Millisecond, OnMissed: func(int) {}},
+		GracePeriod: 50 * time.Millisecond,
+		OnEvict:     func(source string) { evicted <- source },
+	}
+	done := make(chan interface{})
+	resultStream, err := watcher.Run(done)
+	if err != nil {
+		t.Fatalf("unexpected error in watcher.Run(): %v", err)
+	}
+	waitForSource(resultStream, "a")
+
+	writeTargets("b")
+	waitForSource(resultStream, "b")
+	go func() {
+		for range resultStream {
+		}
+	}()
+	select {
+	case source := <-evicted:
+		if source != "a" {
+			t.Errorf("unexpected evicted source: %v != a (observed, expected)", source)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for removed target to be evicted")
+	}
+	close(done)
+}
+
+func TestTargetWatcher_MissingFile(t *testing.T) {
+	watcher := &TargetWatcher{Path: filepath.Join(t.TempDir(), "missing.json")}
+	if _, err := watcher.Run(make(chan interface{})); err == nil {
+		t.Fatal("expected error in watcher.Run(), got none")
+	}
+}
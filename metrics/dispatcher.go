@@ -1,7 +1,11 @@
 package metrics
 
 import (
-	log "github.com/sirupsen/logrus"
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
 )
 
 // MetricDispatcher routes Metric values to their payload specific handlers
@@ -11,38 +15,315 @@ type MetricDispatcher interface {
 
 // ResultStreamDispatcher is a Dispatcher based on channels
 type ResultStreamDispatcher struct {
-	subscriptions map[MetricType]chan interface{}
+	// BufferSize is the number of metrics each subscription channel can hold
+	// before Dispatch blocks on it
+	BufferSize int
+	// DeadLetters, if set, receives batches that failed to decode and metrics
+	// that nothing is subscribed to
+	DeadLetters DeadLetterSink
+	// Errors, if set, receives an ErrorEvent for every failed batch and
+	// unrouted metric, which are otherwise logged
+	Errors *ErrorStream
+
+	mu            sync.RWMutex
+	subscriptions map[MetricType][]*Subscription
+	subscribed    int
+}
+
+// OverflowPolicy decides what Dispatch does when a subscription's buffer is full
+type OverflowPolicy int
+
+const (
+	// BlockOnOverflow waits for the subscriber to make room, stalling delivery
+	// to every other subscriber meanwhile
+	BlockOnOverflow OverflowPolicy = iota
+	// DropNewest discards the metric that didn't fit
+	DropNewest
+	// DropOldest discards the longest-waiting metric to make room
+	DropOldest
+	// SampleOnOverflow keeps one in every SampleRate metrics that don't fit,
+	// making room by discarding the oldest, and discards the rest
+	SampleOnOverflow
+)
+
+func (p OverflowPolicy) String() string {
+	switch p {
+	case BlockOnOverflow:
+		return "block"
+	case DropNewest:
+		return "drop-newest"
+	case DropOldest:
+		return "drop-oldest"
+	case SampleOnOverflow:
+		return "sample"
+	}
+	return "unknown"
+}
+
+// SubscriptionOptions configures a single subscription
+type SubscriptionOptions struct {
+	// Name identifies the subscriber in SubscriptionStats, defaulting to its
+	// metric type and position
+	Name       string
+	BufferSize int
+	Overflow   OverflowPolicy
+	// SampleRate is used by SampleOnOverflow, defaulting to 10
+	SampleRate int
+}
+
+// SubscriptionStats counts what a subscription has been sent. Delivered
+// counts metrics accepted into its buffer, and Dropped those discarded, either
+// on arrival or later to make room
+type SubscriptionStats struct {
+	Name      string
+	Type      MetricType
+	Policy    OverflowPolicy
+	Delivered int64
+	Dropped   int64
+	Queue     QueueDepth
+}
+
+// Subscription is a handle on a single subscriber's channel of metrics
+type Subscription struct {
+	name       string
+	metricType MetricType
+	stream     chan Metric
+	overflow   OverflowPolicy
+	sampleRate int64
+	overflowed int64
+	delivered  int64
+	dropped    int64
+
+	dispatcher *ResultStreamDispatcher
+	cancelOnce sync.Once
+	cancelled  chan struct{}
+	// mu is held for reading while sending so that Cancel can wait for any
+	// in-flight send before closing stream
+	mu     sync.RWMutex
+	closed bool
+}
+
+// Metrics returns the channel metrics are delivered on. It's closed once the
+// subscription is cancelled
+func (s *Subscription) Metrics() <-chan Metric {
+	return s.stream
+}
+
+// Cancel removes the subscription from its dispatcher and closes its channel,
+// leaving every other subscription untouched. It's safe to call while the
+// dispatcher is running, and more than once
+func (s *Subscription) Cancel() {
+	s.cancelOnce.Do(func() {
+		// Unblock any send waiting on a full buffer before waiting for it
+		close(s.cancelled)
+		s.dispatcher.remove(s)
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.closed = true
+		close(s.stream)
+	})
+}
+
+// send delivers the metric according to the subscription's overflow policy.
+// Only the dispatcher sends, so a failed non-blocking send means the buffer
+// really is full
+func (s *Subscription) send(metric Metric) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.closed {
+		return
+	}
+	if s.overflow == BlockOnOverflow {
+		select {
+		case s.stream <- metric:
+			atomic.AddInt64(&s.delivered, 1)
+		case <-s.cancelled:
+			atomic.AddInt64(&s.dropped, 1)
+		}
+		return
+	}
+	select {
+	case s.stream <- metric:
+		atomic.AddInt64(&s.delivered, 1)
+		return
+	default:
+	}
+
+	switch s.overflow {
+	case DropNewest:
+		atomic.AddInt64(&s.dropped, 1)
+		return
+	case SampleOnOverflow:
+		if atomic.AddInt64(&s.overflowed, 1)%s.sampleRate != 0 {
+			atomic.AddInt64(&s.dropped, 1)
+			return
+		}
+	}
+	select {
+	case <-s.stream:
+		atomic.AddInt64(&s.dropped, 1)
+	default:
+	}
+	select {
+	case s.stream <- metric:
+		atomic.AddInt64(&s.delivered, 1)
+	default:
+		atomic.AddInt64(&s.dropped, 1)
+	}
+}
+
+// stats returns the subscription's current counters
+func (s *Subscription) stats() SubscriptionStats {
+	return SubscriptionStats{
+		Name:      s.name,
+		Type:      s.metricType,
+		Policy:    s.overflow,
+		Delivered: atomic.LoadInt64(&s.delivered),
+		Dropped:   atomic.LoadInt64(&s.dropped),
+		Queue:     QueueDepth{Len: len(s.stream), Cap: cap(s.stream)},
+	}
 }
 
 // Subscribe returns a new channel such that all metrics of that type will be
-// sent through that channel
-func (d *ResultStreamDispatcher) Subscribe(t MetricType) <-chan interface{} {
+// sent through that channel. Each subscriber gets its own channel and receives
+// every metric of the type, independently of any other subscribers
+func (d *ResultStreamDispatcher) Subscribe(t MetricType) <-chan Metric {
+	return d.SubscribeWith(t, SubscriptionOptions{BufferSize: d.BufferSize}).Metrics()
+}
+
+// SubscribeWith is like Subscribe, but with its own buffer size and overflow
+// policy so that a slow subscriber needn't hold up the others. The returned
+// Subscription can be cancelled at any time, including while Run is active
+func (d *ResultStreamDispatcher) SubscribeWith(t MetricType, opts SubscriptionOptions) *Subscription {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
 	if d.subscriptions == nil {
-		d.subscriptions = make(map[MetricType]chan interface{})
+		d.subscriptions = make(map[MetricType][]*Subscription)
+	}
+	if opts.Name == "" {
+		d.subscribed++
+		opts.Name = fmt.Sprintf("%v#%v", t, d.subscribed)
+	}
+	if opts.SampleRate <= 0 {
+		opts.SampleRate = 10
+	}
+	sub := &Subscription{
+		name:       opts.Name,
+		metricType: t,
+		stream:     make(chan Metric, opts.BufferSize),
+		overflow:   opts.Overflow,
+		sampleRate: int64(opts.SampleRate),
+		dispatcher: d,
+		cancelled:  make(chan struct{}),
+	}
+	// Copy on write, so that Dispatch can range over a snapshot unlocked
+	subs := make([]*Subscription, 0, len(d.subscriptions[t])+1)
+	d.subscriptions[t] = append(append(subs, d.subscriptions[t]...), sub)
+	return sub
+}
+
+// remove drops sub from the dispatcher's subscriptions
+func (d *ResultStreamDispatcher) remove(sub *Subscription) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	subs := make([]*Subscription, 0, len(d.subscriptions[sub.metricType]))
+	for _, other := range d.subscriptions[sub.metricType] {
+		if other != sub {
+			subs = append(subs, other)
+		}
+	}
+	if len(subs) == 0 {
+		delete(d.subscriptions, sub.metricType)
+	} else {
+		d.subscriptions[sub.metricType] = subs
+	}
+}
+
+// snapshot returns the current subscriptions of every type
+func (d *ResultStreamDispatcher) snapshot() map[MetricType][]*Subscription {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	subscriptions := make(map[MetricType][]*Subscription, len(d.subscriptions))
+	for t, subs := range d.subscriptions {
+		subscriptions[t] = subs
+	}
+	return subscriptions
+}
+
+// SubscriptionStats returns the delivery counters of every subscription
+func (d *ResultStreamDispatcher) SubscriptionStats() []SubscriptionStats {
+	stats := make([]SubscriptionStats, 0)
+	for _, subs := range d.snapshot() {
+		for _, sub := range subs {
+			stats = append(stats, sub.stats())
+		}
 	}
-	d.subscriptions[t] = make(chan interface{})
-	return d.subscriptions[t]
+	return stats
 }
 
-// Close closes the Dispatcher's Subscription channels
+// QueueDepths returns how many metrics are waiting on each subscription, in
+// the order they subscribed
+func (d *ResultStreamDispatcher) QueueDepths() map[MetricType][]QueueDepth {
+	subscriptions := d.snapshot()
+	depths := make(map[MetricType][]QueueDepth, len(subscriptions))
+	for t, subs := range subscriptions {
+		for _, sub := range subs {
+			depths[t] = append(depths[t], QueueDepth{Len: len(sub.stream), Cap: cap(sub.stream)})
+		}
+	}
+	return depths
+}
+
+// Saturation reports the fill level of the most backed-up subscription that
+// blocks on overflow. Subscriptions that drop on overflow never hold up
+// Dispatch, so they don't count
+func (d *ResultStreamDispatcher) Saturation() float64 {
+	max := 0.0
+	for _, subs := range d.snapshot() {
+		for _, sub := range subs {
+			if sub.overflow != BlockOnOverflow {
+				continue
+			}
+			depth := QueueDepth{Len: len(sub.stream), Cap: cap(sub.stream)}
+			if s := depth.Saturation(); max < s {
+				max = s
+			}
+		}
+	}
+	return max
+}
+
+// Close cancels every subscription, closing the Dispatcher's Subscription
+// channels
 func (d *ResultStreamDispatcher) Close() {
-	for _, stream := range d.subscriptions {
-		close(stream)
+	for _, subs := range d.snapshot() {
+		for _, sub := range subs {
+			sub.Cancel()
+		}
 	}
 }
 
 // Run pulls Results off the resultStream and dispatches each batch of Metrics
-func (d ResultStreamDispatcher) Run(done <-chan interface{}, resultStream <-chan Result) {
+func (d *ResultStreamDispatcher) Run(done <-chan interface{}, resultStream <-chan Result) {
+	d.RunContext(contextOf(done), resultStream)
+}
+
+// RunContext is like Run, but stops once ctx is cancelled
+func (d *ResultStreamDispatcher) RunContext(ctx context.Context, resultStream <-chan Result) {
 	for {
 		select {
-		case <-done:
+		case <-ctx.Done():
 			return
 		case result, ok := <-resultStream:
 			if ok == false {
 				return
 			} else if result.Error != nil {
-				// TODO: evaluate if errors should be routed to their own handler
-				log.Error(result.Error)
+				d.reportResultError(result)
 				continue
 			}
 			d.Dispatch(result.Metrics)
@@ -50,13 +331,34 @@ func (d ResultStreamDispatcher) Run(done <-chan interface{}, resultStream <-chan
 	}
 }
 
-// Dispatch sends the payload of each metric in a batch to its designated handler
-func (d ResultStreamDispatcher) Dispatch(metricsBatch []Metric) {
+// reportResultError reports a batch that failed ingestion or decoding, and
+// dead-letters it if it was received but couldn't be decoded
+func (d *ResultStreamDispatcher) reportResultError(result Result) {
+	stage := IngestStage
+	var ingestErr *IngestError
+	if errors.As(result.Error, &ingestErr) && ingestErr.Raw != nil {
+		stage = DecodeStage
+		sendDeadLetter(d.DeadLetters, newDeadLetter(DecodeStage, result.Error, result.Source, "", ingestErr.Raw))
+	}
+	event := newErrorEvent(stage, result.Error, result.Source, "")
+	event.TraceID = TraceID(result.Context())
+	d.Errors.report(event)
+}
+
+// Dispatch sends each metric in a batch to every subscriber of its type
+func (d *ResultStreamDispatcher) Dispatch(metricsBatch []Metric) {
 	for _, metric := range metricsBatch {
-		metricStream, ok := d.subscriptions[metric.Type]
-		if ok == false {
+		d.mu.RLock()
+		subs := d.subscriptions[metric.Type]
+		d.mu.RUnlock()
+		if len(subs) == 0 {
+			err := fmt.Errorf("no subscription for metric type %q", metric.Type)
+			sendDeadLetter(d.DeadLetters, metricDeadLetter(DispatchStage, err, metric))
+			d.Errors.report(newErrorEvent(DispatchStage, err, metric.Source, metric.Type))
 			continue
 		}
-		metricStream <- metric.Payload.Value
+		for _, sub := range subs {
+			sub.send(metric)
+		}
 	}
 }
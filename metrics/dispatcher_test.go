@@ -1,15 +1,18 @@
 package metrics
 
 import (
+	"reflect"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestResultStreamDispatcher_Dispatch(t *testing.T) {
 	dispatcher := &ResultStreamDispatcher{}
 	subscriptionStream := dispatcher.Subscribe(LoadAverageMetric)
 
-	good := Metric{LoadAverageMetric, MetricPayload{}}
-	bad := Metric{CPUUsageMetric, MetricPayload{}}
+	good := Metric{Type: LoadAverageMetric, Payload: MetricPayload{}}
+	bad := Metric{Type: CPUUsageMetric, Payload: MetricPayload{}}
 	batch := []Metric{
 		good,
 		good,
@@ -33,3 +36,199 @@ func TestResultStreamDispatcher_Dispatch(t *testing.T) {
 		t.Errorf("unexpected metrics observed: %v != %v (observed, expected)", metricsObserved, metricsExpected)
 	}
 }
+
+func TestResultStreamDispatcher_QueueDepths(t *testing.T) {
+	dispatcher := &ResultStreamDispatcher{BufferSize: 4}
+	dispatcher.Subscribe(LoadAverageMetric)
+	dispatcher.Subscribe(CPUUsageMetric)
+	dispatcher.Dispatch([]Metric{
+		{Type: LoadAverageMetric, Payload: MetricPayload{}},
+		{Type: LoadAverageMetric, Payload: MetricPayload{}},
+		{Type: CPUUsageMetric, Payload: MetricPayload{}},
+	})
+
+	depths := dispatcher.QueueDepths()
+	if !reflect.DeepEqual(depths[LoadAverageMetric], []QueueDepth{{Len: 2, Cap: 4}}) {
+		t.Errorf("unexpected load_avg depths: %+v", depths[LoadAverageMetric])
+	}
+	if !reflect.DeepEqual(depths[CPUUsageMetric], []QueueDepth{{Len: 1, Cap: 4}}) {
+		t.Errorf("unexpected cpu_usage depths: %+v", depths[CPUUsageMetric])
+	}
+	if s := dispatcher.Saturation(); s != 0.5 {
+		t.Errorf("unexpected saturation: %v != 0.5 (observed, expected)", s)
+	}
+}
+
+func TestResultStreamDispatcher_FanOut(t *testing.T) {
+	dispatcher := &ResultStreamDispatcher{}
+	subscriptionStreams := []<-chan Metric{
+		dispatcher.Subscribe(LoadAverageMetric),
+		dispatcher.Subscribe(LoadAverageMetric),
+		dispatcher.Subscribe(LoadAverageMetric),
+	}
+	batch := []Metric{
+		{Type: LoadAverageMetric, Payload: MetricPayload{Value: LoadAverage(0.5)}},
+		{Type: LoadAverageMetric, Payload: MetricPayload{Value: LoadAverage(1.5)}},
+	}
+
+	var wg sync.WaitGroup
+	observed := make([]int, len(subscriptionStreams))
+	for i, stream := range subscriptionStreams {
+		wg.Add(1)
+		go func(i int, stream <-chan Metric) {
+			defer wg.Done()
+			for range stream {
+				observed[i]++
+			}
+		}(i, stream)
+	}
+	dispatcher.Dispatch(batch)
+	dispatcher.Close()
+	wg.Wait()
+
+	for i, n := range observed {
+		if n != len(batch) {
+			t.Errorf("unexpected metrics observed by subscriber %v: %v != %v (observed, expected)", i, n, len(batch))
+		}
+	}
+}
+
+func TestResultStreamDispatcher_OverflowPolicies(t *testing.T) {
+	loads := func(values ...float64) []Metric {
+		batch := make([]Metric, len(values))
+		for i, v := range values {
+			batch[i] = Metric{Type: LoadAverageMetric, Payload: MetricPayload{Value: LoadAverage(v)}}
+		}
+		return batch
+	}
+	drain := func(stream <-chan Metric) []LoadAverage {
+		observed := make([]LoadAverage, 0)
+		for len(stream) > 0 {
+			observed = append(observed, (<-stream).Payload.Value.(LoadAverage))
+		}
+		return observed
+	}
+	testCases := []struct {
+		Name              string
+		Options           SubscriptionOptions
+		Expected          []LoadAverage
+		ExpectedDelivered int64
+		ExpectedDropped   int64
+	}{
+		{"DropNewest", SubscriptionOptions{BufferSize: 2, Overflow: DropNewest}, []LoadAverage{1, 2}, 2, 4},
+		{"DropOldest", SubscriptionOptions{BufferSize: 2, Overflow: DropOldest}, []LoadAverage{5, 6}, 6, 4},
+		{"Sample", SubscriptionOptions{BufferSize: 2, Overflow: SampleOnOverflow, SampleRate: 2}, []LoadAverage{4, 6}, 4, 4},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.Name, func(t *testing.T) {
+			dispatcher := &ResultStreamDispatcher{}
+			stream := dispatcher.SubscribeWith(LoadAverageMetric, testCase.Options).Metrics()
+			dispatcher.Dispatch(loads(1, 2, 3, 4, 5, 6))
+
+			if observed := drain(stream); !reflect.DeepEqual(observed, testCase.Expected) {
+				t.Errorf("unexpected metrics kept: %v != %v (observed, expected)", observed, testCase.Expected)
+			}
+			stats := dispatcher.SubscriptionStats()[0]
+			if stats.Delivered != testCase.ExpectedDelivered || stats.Dropped != testCase.ExpectedDropped {
+				t.Errorf("unexpected counters: %+v", stats)
+			}
+		})
+	}
+
+	t.Run("SlowSubscriberDoesNotBlockOthers", func(t *testing.T) {
+		dispatcher := &ResultStreamDispatcher{}
+		dispatcher.SubscribeWith(LoadAverageMetric, SubscriptionOptions{Name: "stuck", Overflow: DropNewest})
+		cpuStream := dispatcher.SubscribeWith(CPUUsageMetric, SubscriptionOptions{BufferSize: 1}).Metrics()
+		dispatcher.Dispatch(append(loads(1, 2, 3), Metric{Type: CPUUsageMetric, Payload: MetricPayload{Value: CPUUsage{1}}}))
+		if len(cpuStream) != 1 {
+			t.Error("cpu_usage subscriber starved by a stuck load_avg subscriber")
+		}
+		if dispatcher.Saturation() != 1 {
+			t.Errorf("unexpected saturation: %v != 1 (observed, expected)", dispatcher.Saturation())
+		}
+	})
+}
+
+func TestSubscription_CancelWhileRunning(t *testing.T) {
+	dispatcher := &ResultStreamDispatcher{}
+	kept := dispatcher.SubscribeWith(LoadAverageMetric, SubscriptionOptions{BufferSize: 1})
+	stuck := dispatcher.SubscribeWith(LoadAverageMetric, SubscriptionOptions{})
+
+	done := make(chan interface{})
+	defer close(done)
+	resultStream := make(chan Result)
+	go dispatcher.Run(done, resultStream)
+	batch := []Metric{{Type: LoadAverageMetric, Payload: MetricPayload{Value: LoadAverage(0.5)}}}
+
+	// Nothing reads from stuck, so Run blocks on it until it's cancelled
+	resultStream <- Result{Metrics: batch}
+	stuck.Cancel()
+	stuck.Cancel()
+	if _, ok := <-stuck.Metrics(); ok {
+		t.Error("expected cancelled subscription's channel to be closed")
+	}
+	if metric := <-kept.Metrics(); metric.Payload.Value != LoadAverage(0.5) {
+		t.Errorf("unexpected metric on remaining subscription: %+v", metric)
+	}
+
+	// Subscribe a temporary tap mid-run, then remove it again
+	tap := dispatcher.SubscribeWith(LoadAverageMetric, SubscriptionOptions{Name: "tap", BufferSize: 1})
+	resultStream <- Result{Metrics: batch}
+	if metric := <-tap.Metrics(); metric.Payload.Value != LoadAverage(0.5) {
+		t.Errorf("unexpected metric on tap: %+v", metric)
+	}
+	<-kept.Metrics()
+	tap.Cancel()
+
+	stats := dispatcher.SubscriptionStats()
+	if len(stats) != 1 || stats[0].Delivered != 2 {
+		t.Errorf("unexpected subscriptions after cancelling: %+v", stats)
+	}
+}
+
+func TestResultStreamDispatcher_ConcurrentSubscribe(t *testing.T) {
+	dispatcher := &ResultStreamDispatcher{}
+	batch := []Metric{{Type: LoadAverageMetric, Payload: MetricPayload{Value: LoadAverage(0.5)}}}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				sub := dispatcher.SubscribeWith(LoadAverageMetric, SubscriptionOptions{Overflow: DropNewest})
+				sub.Cancel()
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				dispatcher.Dispatch(batch)
+			}
+		}()
+	}
+	wg.Wait()
+	dispatcher.Close()
+}
+
+func TestResultStreamDispatcher_CloseWhileDispatching(t *testing.T) {
+	dispatcher := &ResultStreamDispatcher{}
+	dispatcher.Subscribe(LoadAverageMetric)
+	batch := []Metric{{Type: LoadAverageMetric, Payload: MetricPayload{Value: LoadAverage(0.5)}}}
+
+	// Nothing reads the subscription, so Dispatch blocks until Close cancels
+	// it, and must then return rather than send on the closed channel
+	dispatched := make(chan struct{})
+	go func() {
+		defer close(dispatched)
+		dispatcher.Dispatch(batch)
+		dispatcher.Dispatch(batch)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	dispatcher.Close()
+	select {
+	case <-dispatched:
+	case <-time.After(time.Second):
+		t.Fatal("Dispatch still blocked after Close")
+	}
+}
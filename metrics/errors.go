@@ -0,0 +1,410 @@
+package metrics
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Sentinel errors for each kind of failure, for matching with errors.Is. The
+// structured error types below match their sentinel, and carry the details
+var (
+	ErrTypeMismatch        = errors.New("metric payload has an unexpected type")
+	ErrCPUCountMismatch    = errors.New("cpu count changed")
+	ErrUnparsableTimestamp = errors.New("unparsable timestamp")
+	ErrHTTPStatus          = errors.New("unsuccessful http status")
+	ErrDecode              = errors.New("unable to decode metrics")
+)
+
+// TypeMismatchError is a metric whose payload isn't the type its handler
+// expects
+type TypeMismatchError struct {
+	Type     MetricType
+	Expected string
+	Value    interface{}
+}
+
+func (e *TypeMismatchError) Error() string {
+	return fmt.Sprintf("failed to cast %v metric to %v, got %T", e.Type, e.Expected, e.Value)
+}
+
+func (e *TypeMismatchError) Is(target error) bool {
+	return target == ErrTypeMismatch
+}
+
+// CPUCountMismatchError is a cpu_usage metric reporting a different number of
+// cores than earlier metrics from the same source
+type CPUCountMismatchError struct {
+	Expected int
+	Observed int
+}
+
+func (e *CPUCountMismatchError) Error() string {
+	return fmt.Sprintf("invalid length of usages array: expected %v, got %v", e.Expected, e.Observed)
+}
+
+func (e *CPUCountMismatchError) Is(target error) bool {
+	return target == ErrCPUCountMismatch
+}
+
+// TimestampError is a kernel upgrade timestamp that isn't valid RFC 3339
+type TimestampError struct {
+	Timestamp string
+	Err       error
+}
+
+func (e *TimestampError) Error() string {
+	return fmt.Sprintf("unable to parse timestamp %q: %v", e.Timestamp, e.Err)
+}
+
+func (e *TimestampError) Unwrap() error {
+	return e.Err
+}
+
+func (e *TimestampError) Is(target error) bool {
+	return target == ErrUnparsableTimestamp
+}
+
+// HTTPStatusError is a 4xx or 5xx response from a demoware API
+type HTTPStatusError struct {
+	StatusCode int
+	Status     string
+}
+
+func (e *HTTPStatusError) Error() string {
+	return fmt.Sprintf("unsuccessful request: %v", e.Status)
+}
+
+func (e *HTTPStatusError) Is(target error) bool {
+	return target == ErrHTTPStatus
+}
+
+// DecodeError is a batch that isn't valid JSON in the demoware API's shape, or
+// a metric whose payload doesn't suit its type, in which case Type is set
+type DecodeError struct {
+	Type MetricType
+	Err  error
+}
+
+func (e *DecodeError) Error() string {
+	if e.Type != "" {
+		return fmt.Sprintf("invalid %v payload: %v", e.Type, e.Err)
+	}
+	return fmt.Sprintf("malformed metrics batch: %v", e.Err)
+}
+
+func (e *DecodeError) Unwrap() error {
+	return e.Err
+}
+
+func (e *DecodeError) Is(target error) bool {
+	return target == ErrDecode
+}
+
+// ErrorKind identifies the specific kind of a failure, finer grained than its
+// ErrorClass, so that e.g. a schema change can be told apart from a flaky
+// network
+type ErrorKind string
+
+const (
+	TypeMismatchKind        ErrorKind = "type_mismatch"
+	CPUCountMismatchKind    ErrorKind = "cpu_count_mismatch"
+	UnparsableTimestampKind ErrorKind = "unparsable_timestamp"
+	HTTPStatusKind          ErrorKind = "http_status"
+	DecodeKind              ErrorKind = "decode"
+	CircuitOpenKind         ErrorKind = "circuit_open"
+	NetworkKind             ErrorKind = "network"
+	UnknownKind             ErrorKind = "unknown"
+)
+
+// KindOf returns the kind of err. Retryable ingest failures that aren't an
+// HTTP status are assumed to be network errors
+func KindOf(err error) ErrorKind {
+	switch {
+	case errors.Is(err, ErrUnparsableTimestamp):
+		return UnparsableTimestampKind
+	case errors.Is(err, ErrDecode):
+		return DecodeKind
+	case errors.Is(err, ErrTypeMismatch):
+		return TypeMismatchKind
+	case errors.Is(err, ErrCPUCountMismatch):
+		return CPUCountMismatchKind
+	case errors.Is(err, ErrHTTPStatus):
+		return HTTPStatusKind
+	case errors.Is(err, ErrCircuitOpen):
+		return CircuitOpenKind
+	case IsRetryable(err):
+		return NetworkKind
+	}
+	return UnknownKind
+}
+
+// ErrorCounter counts errors by kind in a concurrent-safe manner
+type ErrorCounter struct {
+	mu     sync.RWMutex
+	counts map[ErrorKind]int64
+}
+
+// Add counts err under its kind, ignoring nil errors
+func (c *ErrorCounter) Add(err error) {
+	if err == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.counts == nil {
+		c.counts = make(map[ErrorKind]int64)
+	}
+	c.counts[KindOf(err)]++
+}
+
+// Count adds the error of every event received until the stream is closed
+func (c *ErrorCounter) Count(events <-chan ErrorEvent) {
+	for event := range events {
+		c.Add(event.Err)
+	}
+}
+
+// Counts returns the number of errors seen of each kind
+func (c *ErrorCounter) Counts() map[ErrorKind]int64 {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	counts := make(map[ErrorKind]int64, len(c.counts))
+	for kind, n := range c.counts {
+		counts[kind] = n
+	}
+	return counts
+}
+
+// ErrorClass broadly categorises a pipeline error, e.g. for alerting on
+// transient and permanent failures differently
+type ErrorClass string
+
+const (
+	// TransientError is a failure worth retrying, e.g. a refused connection
+	TransientError ErrorClass = "transient"
+	// PermanentError is a failure that won't go away on retry, e.g. a 404
+	PermanentError ErrorClass = "permanent"
+	// CircuitOpenError is a poll skipped while a source's breaker is open
+	CircuitOpenError ErrorClass = "circuit_open"
+	// MalformedError is a batch or payload that couldn't be decoded
+	MalformedError ErrorClass = "malformed"
+	// UnroutedError is a metric of a type nothing is subscribed to
+	UnroutedError ErrorClass = "unrouted"
+	// HandlerError is a metric a handler failed to process
+	HandlerError ErrorClass = "handler"
+)
+
+// ErrorEvent describes a failure anywhere in the pipeline
+type ErrorEvent struct {
+	Time  time.Time
+	Stage string
+	Class ErrorClass
+	Kind  ErrorKind
+	// Source, Type and TraceID are set when known at the failing stage
+	Source  string
+	Type    MetricType
+	TraceID string
+	Err     error
+}
+
+// newErrorEvent builds an ErrorEvent, classifying err by the stage it
+// happened at
+func newErrorEvent(stage string, err error, source string, t MetricType) ErrorEvent {
+	return ErrorEvent{
+		Time:   time.Now(),
+		Stage:  stage,
+		Class:  classifyError(stage, err),
+		Kind:   KindOf(err),
+		Source: source,
+		Type:   t,
+		Err:    err,
+	}
+}
+
+// classifyError returns the ErrorClass of an error raised at the given stage
+func classifyError(stage string, err error) ErrorClass {
+	switch stage {
+	case DispatchStage:
+		return UnroutedError
+	case HandleStage:
+		return HandlerError
+	case DecodeStage:
+		return MalformedError
+	}
+	if errors.Is(err, ErrCircuitOpen) {
+		return CircuitOpenError
+	}
+	if IsRetryable(err) {
+		return TransientError
+	}
+	return PermanentError
+}
+
+// ErrorStream publishes ErrorEvents to any number of subscribers. Publishing
+// never blocks: events that don't fit in a subscriber's buffer are dropped
+// and counted, so a slow subscriber can't stall the pipeline
+type ErrorStream struct {
+	// BufferSize is the number of events each subscription can hold before
+	// further events are dropped for it
+	BufferSize int
+
+	mu          sync.RWMutex
+	subscribers []chan ErrorEvent
+	closed      bool
+	published   int64
+	dropped     int64
+}
+
+// ErrorStreamStats counts the events published on an ErrorStream, and those
+// dropped for a full subscriber
+type ErrorStreamStats struct {
+	Published int64
+	Dropped   int64
+}
+
+// Subscribe returns a channel receiving every event published from now on,
+// and a function cancelling the subscription and closing the channel
+func (s *ErrorStream) Subscribe() (<-chan ErrorEvent, func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	events := make(chan ErrorEvent, s.BufferSize)
+	if s.closed {
+		close(events)
+		return events, func() {}
+	}
+	s.subscribers = append(s.subscribers, events)
+	var cancelOnce sync.Once
+	cancel := func() {
+		cancelOnce.Do(func() { s.unsubscribe(events) })
+	}
+	return events, cancel
+}
+
+// unsubscribe removes and closes the given subscriber channel, unless the
+// stream has already closed it
+func (s *ErrorStream) unsubscribe(events chan ErrorEvent) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, subscriber := range s.subscribers {
+		if subscriber == events {
+			s.subscribers = append(s.subscribers[:i], s.subscribers[i+1:]...)
+			close(events)
+			return
+		}
+	}
+}
+
+// Publish sends event to every subscriber with room for it
+func (s *ErrorStream) Publish(event ErrorEvent) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.closed {
+		return
+	}
+	atomic.AddInt64(&s.published, 1)
+	for _, subscriber := range s.subscribers {
+		select {
+		case subscriber <- event:
+		default:
+			atomic.AddInt64(&s.dropped, 1)
+		}
+	}
+}
+
+// Close closes every subscription. Later events are discarded
+func (s *ErrorStream) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return
+	}
+	s.closed = true
+	for _, subscriber := range s.subscribers {
+		close(subscriber)
+	}
+	s.subscribers = nil
+}
+
+// CurrentStats returns the stream's counters
+func (s *ErrorStream) CurrentStats() ErrorStreamStats {
+	return ErrorStreamStats{
+		Published: atomic.LoadInt64(&s.published),
+		Dropped:   atomic.LoadInt64(&s.dropped),
+	}
+}
+
+// report publishes event on the stream, or logs it if there's no stream
+func (s *ErrorStream) report(event ErrorEvent) {
+	if s != nil {
+		s.Publish(event)
+		return
+	}
+	logErrorEvent(event)
+}
+
+// LogErrors logs every event received until the stream is closed
+func LogErrors(events <-chan ErrorEvent) {
+	for event := range events {
+		logErrorEvent(event)
+	}
+}
+
+// logErrorEvent logs event with its details as fields. Unrouted metrics are
+// expected while nothing subscribes to a type, so they're only logged at
+// debug level
+func logErrorEvent(event ErrorEvent) {
+	entry := log.WithFields(log.Fields{
+		"stage": event.Stage,
+		"class": event.Class,
+		"kind":  event.Kind,
+	})
+	if event.Source != "" {
+		entry = entry.WithField("source", event.Source)
+	}
+	if event.Type != "" {
+		entry = entry.WithField("type", event.Type)
+	}
+	if event.TraceID != "" {
+		entry = entry.WithField("trace_id", event.TraceID)
+	}
+	if event.Class == UnroutedError {
+		entry.Debug(event.Err)
+		return
+	}
+	entry.Error(event.Err)
+}
+
+// ErrorReportingHandler wraps a Handler, publishing every failure to Errors as
+// a HandleStage event. Failures are reported rather than returned, so
+// RunMetricStreamHandler doesn't log them too
+type ErrorReportingHandler struct {
+	Handler Handler
+	Type    MetricType
+	Errors  *ErrorStream
+}
+
+// Handle passes the metric to the wrapped Handler
+func (h *ErrorReportingHandler) Handle(metric interface{}) error {
+	return h.HandleFrom("", metric)
+}
+
+// HandleFrom passes the metric to the wrapped Handler, along with its source
+// if the wrapped Handler wants it
+func (h *ErrorReportingHandler) HandleFrom(source string, metric interface{}) error {
+	m := Metric{Type: h.Type, Payload: MetricPayload{Value: metric}, Source: source}
+	if err := handleMetric(h.Handler, m); err != nil {
+		h.Errors.report(newErrorEvent(HandleStage, err, source, h.Type))
+	}
+	return nil
+}
@@ -0,0 +1,154 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestErrorStream(t *testing.T) {
+	stream := &ErrorStream{BufferSize: 1}
+	events, cancel := stream.Subscribe()
+	full, _ := stream.Subscribe()
+
+	stream.Publish(ErrorEvent{Stage: IngestStage})
+	<-events
+	stream.Publish(ErrorEvent{Stage: DecodeStage})
+	if event := <-events; event.Stage != DecodeStage {
+		t.Errorf("unexpected stage: %v != %v (observed, expected)", event.Stage, DecodeStage)
+	}
+	stats := stream.CurrentStats()
+	if stats.Published != 2 || stats.Dropped != 1 {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+
+	cancel()
+	cancel()
+	if _, ok := <-events; ok {
+		t.Error("expected cancelled subscription's channel to be closed")
+	}
+	stream.Close()
+	stream.Publish(ErrorEvent{Stage: HandleStage})
+	<-full
+	if _, ok := <-full; ok {
+		t.Error("expected subscription's channel to be closed with the stream")
+	}
+}
+
+func TestClassifyError(t *testing.T) {
+	testCases := []struct {
+		Stage    string
+		Err      error
+		Expected ErrorClass
+	}{
+		{IngestStage, &IngestError{Err: errors.New("connection refused"), Retryable: true}, TransientError},
+		{IngestStage, &IngestError{Err: errors.New("404 Not Found")}, PermanentError},
+		{IngestStage, ErrCircuitOpen, CircuitOpenError},
+		{DecodeStage, &IngestError{Err: errors.New("bad json"), Raw: []byte("{")}, MalformedError},
+		{DispatchStage, errors.New("no subscription"), UnroutedError},
+		{HandleStage, errors.New("bad payload"), HandlerError},
+	}
+	for i, testCase := range testCases {
+		t.Run(fmt.Sprintf("ValidCase%v", i), func(t *testing.T) {
+			if observed := classifyError(testCase.Stage, testCase.Err); observed != testCase.Expected {
+				t.Errorf("unexpected class: %v != %v (observed, expected)", observed, testCase.Expected)
+			}
+		})
+	}
+}
+
+func TestResultStreamDispatcher_Errors(t *testing.T) {
+	stream := &ErrorStream{BufferSize: 8}
+	events, _ := stream.Subscribe()
+	dispatcher := &ResultStreamDispatcher{Errors: stream}
+
+	done := make(chan interface{})
+	defer close(done)
+	resultStream := make(chan Result)
+	go dispatcher.Run(done, resultStream)
+	ctx := WithTraceID(context.Background(), "abc123")
+	resultStream <- Result{Source: "web-1", Error: &IngestError{Err: errors.New("refused"), Retryable: true}}.WithContext(ctx)
+	resultStream <- Result{Source: "web-1", Error: &IngestError{Err: errors.New("bad json"), Raw: []byte("{")}}
+	resultStream <- Result{Source: "web-1", Metrics: []Metric{{Type: "unknown", Source: "web-1"}}}
+
+	expected := []ErrorEvent{
+		{Stage: IngestStage, Class: TransientError, Source: "web-1", TraceID: "abc123"},
+		{Stage: DecodeStage, Class: MalformedError, Source: "web-1"},
+		{Stage: DispatchStage, Class: UnroutedError, Source: "web-1", Type: "unknown"},
+	}
+	for _, e := range expected {
+		event := <-events
+		if event.Stage != e.Stage || event.Class != e.Class || event.Source != e.Source || event.Type != e.Type || event.TraceID != e.TraceID {
+			t.Errorf("unexpected event: %+v != %+v (observed, expected)", event, e)
+		}
+	}
+}
+
+func TestErrorReportingHandler(t *testing.T) {
+	stream := &ErrorStream{BufferSize: 1}
+	events, _ := stream.Subscribe()
+	handler := &ErrorReportingHandler{Handler: &LoadMetricsHandler{}, Type: LoadAverageMetric, Errors: stream}
+
+	if err := handler.HandleFrom("web-1", "not a load average"); err != nil {
+		t.Errorf("expected failure to be reported rather than returned: %v", err)
+	}
+	event := <-events
+	if event.Stage != HandleStage || event.Class != HandlerError || event.Source != "web-1" || event.Type != LoadAverageMetric {
+		t.Errorf("unexpected event: %+v", event)
+	}
+}
+
+func TestKindOf(t *testing.T) {
+	_, parseErr := time.Parse(time.RFC3339, "NO. BAD TIMESTAMP. BAD.")
+	testCases := []struct {
+		Err      error
+		Sentinel error
+		Expected ErrorKind
+	}{
+		{&TypeMismatchError{Type: LoadAverageMetric, Expected: "LoadAverage", Value: "0.5"}, ErrTypeMismatch, TypeMismatchKind},
+		{&CPUCountMismatchError{Expected: 4, Observed: 8}, ErrCPUCountMismatch, CPUCountMismatchKind},
+		{&TimestampError{Timestamp: "NO. BAD TIMESTAMP. BAD.", Err: parseErr}, ErrUnparsableTimestamp, UnparsableTimestampKind},
+		{&IngestError{Err: &HTTPStatusError{StatusCode: 503, Status: "503 Service Unavailable"}, Retryable: true}, ErrHTTPStatus, HTTPStatusKind},
+		{&IngestError{Err: &DecodeError{Err: errors.New("unexpected EOF")}, Raw: []byte("[")}, ErrDecode, DecodeKind},
+		{ErrCircuitOpen, ErrCircuitOpen, CircuitOpenKind},
+		{&IngestError{Err: errors.New("connection refused"), Retryable: true}, nil, NetworkKind},
+		{errors.New("something else"), nil, UnknownKind},
+	}
+	for i, testCase := range testCases {
+		t.Run(fmt.Sprintf("ValidCase%v", i), func(t *testing.T) {
+			if observed := KindOf(testCase.Err); observed != testCase.Expected {
+				t.Errorf("unexpected kind: %v != %v (observed, expected)", observed, testCase.Expected)
+			}
+			if testCase.Sentinel != nil && !errors.Is(testCase.Err, testCase.Sentinel) {
+				t.Errorf("expected %v to match %v", testCase.Err, testCase.Sentinel)
+			}
+		})
+	}
+
+	// Decoding a payload of the wrong shape fails as both a decode error and
+	// the more specific kind, which takes precedence
+	_, err := unmarshalMetricsBatch([]byte(`[{"type": "last_kernel_upgrade", "payload": {"value": "yesterday"}}]`))
+	var decodeErr *DecodeError
+	if !errors.As(err, &decodeErr) || decodeErr.Type != LastKernelUpgradeMetric {
+		t.Errorf("expected a DecodeError for last_kernel_upgrade, got %v", err)
+	}
+	if observed := KindOf(err); observed != UnparsableTimestampKind {
+		t.Errorf("unexpected kind: %v != %v (observed, expected)", observed, UnparsableTimestampKind)
+	}
+}
+
+func TestErrorCounter(t *testing.T) {
+	counter := &ErrorCounter{}
+	counter.Add(nil)
+	counter.Add(&CPUCountMismatchError{Expected: 4, Observed: 8})
+	counter.Add(&CPUCountMismatchError{Expected: 4, Observed: 2})
+	counter.Add(ErrCircuitOpen)
+
+	expected := map[ErrorKind]int64{CPUCountMismatchKind: 2, CircuitOpenKind: 1}
+	if observed := counter.Counts(); !reflect.DeepEqual(observed, expected) {
+		t.Errorf("unexpected counts: %v != %v (observed, expected)", observed, expected)
+	}
+}
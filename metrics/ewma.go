@@ -0,0 +1,92 @@
+package metrics
+
+import (
+	"math"
+	"time"
+)
+
+// DefaultCPUHalfLives are the half-lives a CPUMetricsHandler keeps moving
+// averages over, unless given its own, after the kernel's 1, 5 and 15 minute
+// load averages
+var DefaultCPUHalfLives = []time.Duration{time.Minute, 5 * time.Minute, 15 * time.Minute}
+
+// EWMA is an exponentially weighted moving average per core with the given
+// half-life: a sample HalfLife old carries half the weight of a new one. A
+// zero HalfLife follows the latest sample
+type EWMA struct {
+	HalfLife time.Duration
+	Values   []float64
+}
+
+// ewmaSet keeps a moving average per core for each of its half-lives, along
+// with when each core was last sampled
+type ewmaSet struct {
+	averages []EWMA
+	last     []time.Time
+}
+
+func newEWMASet(halfLives []time.Duration) *ewmaSet {
+	e := &ewmaSet{averages: make([]EWMA, len(halfLives))}
+	for i, halfLife := range halfLives {
+		if halfLife < 0 {
+			halfLife = 0
+		}
+		e.averages[i] = EWMA{HalfLife: halfLife}
+	}
+	return e
+}
+
+// resize adds unsampled cores or drops the highest cores to keep cpuCount
+func (e *ewmaSet) resize(cpuCount int) {
+	e.last = resizeSlice(e.last, cpuCount)
+	for i := range e.averages {
+		e.averages[i].Values = resizeSlice(e.averages[i].Values, cpuCount)
+	}
+}
+
+// add decays the averages of each core sampled by the time elapsed since its
+// previous sample and moves them toward the usages seen at the given time. A
+// core's first sample seeds its averages, and samples out of order are
+// weighted as if simultaneous
+func (e *ewmaSet) add(at time.Time, usages []float64) {
+	for j, usage := range usages {
+		first := e.last[j].IsZero()
+		elapsed := at.Sub(e.last[j])
+		if elapsed < 0 {
+			elapsed = 0
+		}
+		if first || e.last[j].Before(at) {
+			e.last[j] = at
+		}
+		for i := range e.averages {
+			weight := 1.0
+			if first == false {
+				weight = decayWeight(e.averages[i].HalfLife, elapsed)
+			}
+			e.averages[i].Values[j] += weight * (usage - e.averages[i].Values[j])
+		}
+	}
+}
+
+// decayWeight returns how far an average with the given half-life moves toward
+// a sample seen elapsed after the previous one: all the way without a
+// half-life, and not at all for a simultaneous sample
+func decayWeight(halfLife, elapsed time.Duration) float64 {
+	switch {
+	case halfLife <= 0:
+		return 1
+	case elapsed <= 0:
+		return 0
+	}
+	return 1 - math.Exp(-math.Ln2*float64(elapsed)/float64(halfLife))
+}
+
+// snapshot returns a copy of the averages, in the order the half-lives were
+// given
+func (e *ewmaSet) snapshot() []EWMA {
+	averages := make([]EWMA, len(e.averages))
+	for i, average := range e.averages {
+		averages[i] = EWMA{HalfLife: average.HalfLife, Values: append([]float64{}, average.Values...)}
+	}
+	return averages
+}
@@ -0,0 +1,95 @@
+package metrics
+
+import (
+	"fmt"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestCPUUsageStats_EWMAs(t *testing.T) {
+	start := time.Date(2020, 4, 2, 11, 0, 0, 0, time.UTC)
+	stats := CPUUsageStats{halfLives: []time.Duration{time.Minute, 10 * time.Minute}}
+	// A week idle, then a minute pinned on the first core
+	for i := 0; i < 7*24*60; i++ {
+		stats.UpdateAt([]float64{0, 0}, start.Add(time.Duration(i)*time.Minute))
+	}
+	stats.UpdateAt([]float64{100, 0}, start.Add(7*24*time.Hour))
+
+	testCases := []struct {
+		Observed float64
+		Expected float64
+	}{
+		// One half-life has passed since the previous sample
+		{Observed: stats.ewmas.averages[0].Values[0], Expected: 50},
+		{Observed: stats.ewmas.averages[0].Values[1], Expected: 0},
+		// A tenth of one has
+		{Observed: stats.ewmas.averages[1].Values[0], Expected: 100 * (1 - math.Pow(0.5, 0.1))},
+	}
+	for i, testCase := range testCases {
+		t.Run(fmt.Sprintf("ValidCase%v", i), func(t *testing.T) {
+			if 1e-9 < math.Abs(testCase.Observed-testCase.Expected) {
+				t.Errorf("unexpected EWMA: %v != %v (observed, expected)", testCase.Observed, testCase.Expected)
+			}
+		})
+	}
+	// The cumulative average has barely moved
+	if 0.01 < stats.Averages[0] {
+		t.Errorf("unexpected stats.Averages[0]: %v, expected under 0.01", stats.Averages[0])
+	}
+
+	// Special bad cases
+	t.Run("OutOfOrder", func(t *testing.T) {
+		before := stats.ewmas.averages[0].Values[0]
+		stats.UpdateAt([]float64{0, 0}, start)
+		if stats.ewmas.averages[0].Values[0] != before {
+			t.Errorf("unexpected EWMA after an out of order sample: %v != %v (observed, expected)", stats.ewmas.averages[0].Values[0], before)
+		}
+		if !stats.ewmas.last[0].Equal(start.Add(7 * 24 * time.Hour)) {
+			t.Errorf("unexpected time of last sample: %v", stats.ewmas.last[0])
+		}
+	})
+}
+
+func TestCPUMetricsHandler_EWMAs(t *testing.T) {
+	handler := &CPUMetricsHandler{}
+	handler.Handle(CPUUsage{10, 20})
+
+	stats := handler.CurrentStats()
+	if len(stats.EWMAs) != len(DefaultCPUHalfLives) {
+		t.Fatalf("unexpected number of EWMAs: %v != %v (observed, expected)", len(stats.EWMAs), len(DefaultCPUHalfLives))
+	}
+	for i, ewma := range stats.EWMAs {
+		if ewma.HalfLife != DefaultCPUHalfLives[i] {
+			t.Errorf("unexpected half-life: %v != %v (observed, expected)", ewma.HalfLife, DefaultCPUHalfLives[i])
+		}
+		// The first sample seeds every average
+		if ewma.Values[0] != 10 || ewma.Values[1] != 20 {
+			t.Errorf("unexpected EWMA values: %v != [10 20] (observed, expected)", ewma.Values)
+		}
+	}
+
+	stats.EWMAs[0].Values[0] = 99
+	if handler.CurrentStats().EWMAs[0].Values[0] != 10 {
+		t.Errorf("internal stats modified by external code")
+	}
+}
+
+func TestCPUUsageStats_EWMAsDegenerateHalfLives(t *testing.T) {
+	start := time.Date(2020, 4, 2, 11, 0, 0, 0, time.UTC)
+	stats := CPUUsageStats{halfLives: []time.Duration{0, -time.Minute, time.Minute}}
+	stats.UpdateAt([]float64{10}, start)
+	stats.UpdateAt([]float64{20}, start)
+	stats.UpdateAt([]float64{30}, start.Add(time.Minute))
+
+	// Without a half-life the average follows the latest usage, and a
+	// simultaneous sample leaves the others as they were
+	for i, expected := range []float64{30, 30, 20} {
+		t.Run(fmt.Sprintf("ValidCase%v", i), func(t *testing.T) {
+			observed := stats.ewmas.averages[i]
+			if observed.HalfLife < 0 || observed.Values[0] != expected {
+				t.Errorf("unexpected EWMA: %+v, expected a value of %v", observed, expected)
+			}
+		})
+	}
+}
@@ -1,28 +1,79 @@
 package metrics
 
 import (
+	"context"
 	"encoding/json"
-	"fmt"
+	"errors"
 	"io/ioutil"
 	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/sambarnes/demoware-consumer/stage"
+	log "github.com/sirupsen/logrus"
 )
 
 // TODO: better configuration mangagement for remote API url
 var DemowareMetricsURL = "http://localhost:8080/metrics"
 
+// Target is a demoware API to scrape
+type Target struct {
+	// Name labels each metric scraped from this target, defaulting to the
+	// host portion of URL
+	Name string `json:"name,omitempty" yaml:"name,omitempty"`
+	URL  string `json:"url" yaml:"url"`
+	// Recorder, if set, captures every raw batch scraped from this target
+	Recorder *Recorder `json:"-" yaml:"-"`
+}
+
+// Label returns the source label for metrics scraped from this target
+func (t Target) Label() string {
+	if t.Name != "" {
+		return t.Name
+	}
+	if u, err := url.Parse(t.URL); err == nil && u.Host != "" {
+		return u.Host
+	}
+	return t.URL
+}
+
 type Result struct {
+	Source  string
 	Error   error
 	Metrics []Metric
+
+	ctx context.Context
+}
+
+// Context returns the context the batch was produced under, carrying its
+// trace ID and source label. It defaults to context.Background()
+func (r Result) Context() context.Context {
+	if r.ctx == nil {
+		return context.Background()
+	}
+	return r.ctx
+}
+
+// WithContext returns a copy of the Result carrying ctx
+func (r Result) WithContext(ctx context.Context) Result {
+	r.ctx = ctx
+	return r
 }
 
 type Metric struct {
 	Type    MetricType    `json:"type"`
 	Payload MetricPayload `json:"payload"`
+	// Source labels the target the metric came from. It's set by the Source
+	// that ingested the metric, overriding any label in the payload unless a
+	// Receiver is told to trust it
+	Source string `json:"source,omitempty"`
 }
 
 type MetricType string
 
 type MetricPayload struct {
+	// Value is decoded by the PayloadDecoder registered for the metric's type,
+	// e.g. a LoadAverage for "load_avg" metrics
 	Value interface{} `json:"value"`
 }
 
@@ -32,50 +83,241 @@ const (
 	LastKernelUpgradeMetric MetricType = "last_kernel_upgrade"
 )
 
-func runGenerator(done <-chan interface{}) <-chan interface{} {
-	return repeatFn(done, ingest)
+// IngestError wraps a failed call to the demoware API, recording whether the
+// failure is transient and worth retrying (connection errors, 5xx, 429) or not
+// (other 4xx, malformed payloads)
+type IngestError struct {
+	Err       error
+	Retryable bool
+	// Raw is the payload that failed to decode, if the failure was in decoding
+	Raw []byte
+}
+
+func (e *IngestError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *IngestError) Unwrap() error {
+	return e.Err
+}
+
+// IsRetryable reports whether err is an IngestError worth retrying
+func IsRetryable(err error) bool {
+	var ingestErr *IngestError
+	return errors.As(err, &ingestErr) && ingestErr.Retryable
+}
+
+// ingestGuard wraps ingest with exponential backoff on retryable failures and
+// a circuit breaker that stops polling a source that keeps failing
+type ingestGuard struct {
+	backoff  Backoff
+	breaker  *CircuitBreaker
+	failures int
+	ingest   func(ctx context.Context) Result
+}
+
+func newIngestGuard(fn func(ctx context.Context) Result) *ingestGuard {
+	return &ingestGuard{
+		backoff: DefaultBackoff,
+		breaker: NewCircuitBreaker(DefaultBreakerThreshold, DefaultBreakerCooldown),
+		ingest:  fn,
+	}
+}
+
+// delay returns how long to wait before the next call
+func (g *ingestGuard) delay() time.Duration {
+	if remaining := g.breaker.Remaining(); 0 < remaining {
+		return remaining
+	}
+	return g.backoff.Duration(g.failures)
+}
+
+// call makes the guarded call, updating the backoff and breaker state. Every
+// failure backs off, and only a success resets the backoff, so a source that
+// keeps answering 404 isn't polled as fast as it responds. Only retryable
+// failures count against the breaker, since a non-retryable one still means
+// the source is reachable
+func (g *ingestGuard) call(ctx context.Context) Result {
+	if !g.breaker.Allow() {
+		return Result{Error: ErrCircuitOpen}
+	}
+	result := g.ingest(ctx)
+	switch {
+	case result.Error == nil:
+		g.failures = 0
+		g.breaker.Success()
+	case IsRetryable(result.Error):
+		g.failures++
+		g.breaker.Failure()
+	default:
+		g.failures++
+		g.breaker.Success()
+	}
+	return result
+}
+
+// runGenerator scrapes target under ctx until stop is cancelled, still
+// sending the Result of any request already made unless ctx is cancelled too
+func runGenerator(ctx, stop context.Context, target Target, schedule PollSchedule, output SaturationGauge) <-chan Result {
+	guard := newIngestGuard(func(ctx context.Context) Result {
+		return target.fetch(ctx, schedule.Timeout)
+	})
+	// Refused calls are labelled too, so an open breaker can be traced to
+	// its target
+	call := func() Result {
+		return target.labelled(ctx, guard.call)
+	}
+	clock := newPollClock(schedule)
+	delay := func() time.Duration {
+		if bp := schedule.Backpressure; bp != nil && bp.Policy != nil {
+			bp.wait(stop, output)
+		}
+		return clock.delayAfter(guard.delay())
+	}
+	return stage.RepeatWithDelayUntil(ctx, stop, call, delay)
 }
 
 // RunGenerator repeatedly calls the metrics API and returns a channel that
 // streams responses as Result structs
 func RunGenerator(done <-chan interface{}) <-chan Result {
-	return toResult(done, runGenerator(done))
+	return RunGeneratorContext(contextOf(done))
+}
+
+// RunGeneratorContext is like RunGenerator, but stops and aborts any request
+// in flight once ctx is cancelled
+func RunGeneratorContext(ctx context.Context) <-chan Result {
+	return RunGeneratorEveryContext(ctx, PollSchedule{})
+}
+
+// RunGeneratorEvery calls the metrics API according to the given schedule and
+// returns a channel that streams responses as Result structs
+func RunGeneratorEvery(done <-chan interface{}, schedule PollSchedule) <-chan Result {
+	return RunGeneratorEveryContext(contextOf(done), schedule)
+}
+
+// RunGeneratorEveryContext is like RunGeneratorEvery, but stops and aborts any
+// request in flight once ctx is cancelled
+func RunGeneratorEveryContext(ctx context.Context, schedule PollSchedule) <-chan Result {
+	return RunTargetGeneratorContext(ctx, Target{URL: DemowareMetricsURL}, schedule)
 }
 
 // RunGeneratorN calls the metrics API N times and returns a channel that
 // streams those responses as Result structs
 func RunGeneratorN(done <-chan interface{}, n int) <-chan Result {
-	return toResult(done, take(done, runGenerator(done), n))
+	return RunGeneratorNContext(contextOf(done), n)
+}
+
+// RunGeneratorNContext is like RunGeneratorN, but stops and aborts any request
+// in flight once ctx is cancelled
+func RunGeneratorNContext(ctx context.Context, n int) <-chan Result {
+	target := Target{URL: DemowareMetricsURL}
+	return stage.Take(ctx, runGenerator(ctx, ctx, target, PollSchedule{}, nil), n)
 }
 
-// ingest makes a call to the remote demoware API returns the Result
-func ingest() interface{} {
-	resp, err := http.Get(DemowareMetricsURL)
+// RunTargetGenerator scrapes a single target according to the given schedule
+// and returns a channel that streams responses as Result structs
+func RunTargetGenerator(done <-chan interface{}, target Target, schedule PollSchedule) <-chan Result {
+	return RunTargetGeneratorContext(contextOf(done), target, schedule)
+}
+
+// RunTargetGeneratorContext is like RunTargetGenerator, but stops and aborts
+// any request in flight once ctx is cancelled. Each Result's context carries
+// ctx's values along with the target's source label and a trace ID
+func RunTargetGeneratorContext(ctx context.Context, target Target, schedule PollSchedule) <-chan Result {
+	return runTargetGenerator(ctx, ctx, target, schedule)
+}
+
+// runTargetGenerator is like RunTargetGeneratorContext, but only stops polling
+// once stop is cancelled, closing the stream after the Results already
+// buffered are read
+func runTargetGenerator(ctx, stop context.Context, target Target, schedule PollSchedule) <-chan Result {
+	resultStream := make(chan Result, schedule.Buffer)
+	return stage.Into(ctx, runGenerator(ctx, stop, target, schedule, ResultStreamSaturation(resultStream)), resultStream)
+}
+
+// RunTargetsGenerator scrapes each target with its own generator, sharing the
+// given schedule, and fans their Results in to a single channel
+func RunTargetsGenerator(done <-chan interface{}, targets []Target, schedule PollSchedule) <-chan Result {
+	return RunTargetsGeneratorContext(contextOf(done), targets, schedule)
+}
+
+// RunTargetsGeneratorContext is like RunTargetsGenerator, but stops and aborts
+// any requests in flight once ctx is cancelled
+func RunTargetsGeneratorContext(ctx context.Context, targets []Target, schedule PollSchedule) <-chan Result {
+	return runTargetsGenerator(ctx, ctx, targets, schedule)
+}
+
+// runTargetsGenerator is like RunTargetsGeneratorContext, but only stops
+// polling once stop is cancelled, like runTargetGenerator
+func runTargetsGenerator(ctx, stop context.Context, targets []Target, schedule PollSchedule) <-chan Result {
+	resultStreams := make([]<-chan Result, len(targets))
+	for i, target := range targets {
+		resultStreams[i] = runTargetGenerator(ctx, stop, target, schedule)
+	}
+	return stage.FanIn(ctx, resultStreams...)
+}
+
+// labelled calls fn under a copy of ctx carrying the target's source label and
+// a trace ID, then labels the Result and its metrics with the source
+func (t Target) labelled(ctx context.Context, fn func(ctx context.Context) Result) Result {
+	ctx = WithSource(ctx, t.Label())
+	if TraceID(ctx) == "" {
+		ctx = WithTraceID(ctx, NewTraceID())
+	}
+	result := fn(ctx)
+	result.Source = t.Label()
+	result.Metrics = labelMetrics(result.Metrics, result.Source)
+	return result.WithContext(ctx)
+}
+
+// fetch makes a call to the target's demoware API and returns the Result. The
+// call is abandoned if ctx is cancelled or timeout (if non-zero) elapses first
+func (t Target) fetch(ctx context.Context, timeout time.Duration) Result {
+	if 0 < timeout {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, t.URL, nil)
 	if err != nil {
 		return Result{
-			Error:   err,
+			Error:   &IngestError{Err: err, Retryable: false},
 			Metrics: nil,
 		}
-	} else if 400 <= resp.StatusCode && resp.StatusCode <= 599 {
+	}
+	req.Header.Set(TraceHeader, TraceID(ctx))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
 		return Result{
-			Error:   fmt.Errorf("unsucessful request: %v", resp.Status),
+			Error:   &IngestError{Err: err, Retryable: true},
 			Metrics: nil,
 		}
 	}
-	// TODO: exponential backoff on certain types of errors
 	defer resp.Body.Close()
+	if 400 <= resp.StatusCode && resp.StatusCode <= 599 {
+		retryable := resp.StatusCode == http.StatusTooManyRequests || 500 <= resp.StatusCode
+		return Result{
+			Error:   &IngestError{Err: &HTTPStatusError{StatusCode: resp.StatusCode, Status: resp.Status}, Retryable: retryable},
+			Metrics: nil,
+		}
+	}
 
 	responseData, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
 		return Result{
-			Error:   err,
+			Error:   &IngestError{Err: err, Retryable: true},
 			Metrics: nil,
 		}
 	}
+	if t.Recorder != nil {
+		if err := t.Recorder.Record(t.Label(), time.Now(), responseData); err != nil {
+			log.WithField("source", t.Label()).Error(err)
+		}
+	}
 	metrics, err := unmarshalMetricsBatch(responseData)
 	if err != nil {
 		return Result{
-			Error:   err,
+			Error:   &IngestError{Err: err, Retryable: false, Raw: responseData},
 			Metrics: nil,
 		}
 	}
@@ -85,11 +327,15 @@ func ingest() interface{} {
 	}
 }
 
+// unmarshalMetricsBatch decodes a batch of metrics, failing with a DecodeError
 func unmarshalMetricsBatch(data []byte) ([]Metric, error) {
 	metrics := make([]Metric, 0)
 	err := json.Unmarshal(data, &metrics)
-	if err != nil {
-		return nil, err
+	var decodeErr *DecodeError
+	if errors.As(err, &decodeErr) {
+		return nil, decodeErr
+	} else if err != nil {
+		return nil, &DecodeError{Err: err}
 	}
 	return metrics, nil
 }
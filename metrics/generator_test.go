@@ -0,0 +1,78 @@
+package metrics
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestTarget_Label(t *testing.T) {
+	testCases := []struct {
+		Target   Target
+		Expected string
+	}{
+		{Target{Name: "web-1", URL: "http://10.0.0.1:8080/metrics"}, "web-1"},
+		{Target{URL: "http://10.0.0.1:8080/metrics"}, "10.0.0.1:8080"},
+		{Target{URL: "not a url"}, "not a url"},
+	}
+	for i, testCase := range testCases {
+		t.Run(fmt.Sprintf("Case%v", i), func(t *testing.T) {
+			if label := testCase.Target.Label(); label != testCase.Expected {
+				t.Errorf("unexpected label: %v != %v (observed, expected)", label, testCase.Expected)
+			}
+		})
+	}
+}
+
+func TestRunTargetsGenerator(t *testing.T) {
+	newServer := func(load float64) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprintf(w, `[{"type": "load_avg", "payload": {"value": %v}}]`, load)
+		}))
+	}
+	serverA, serverB := newServer(0.5), newServer(1.5)
+	defer serverA.Close()
+	defer serverB.Close()
+
+	done := make(chan interface{})
+	defer close(done)
+	targets := []Target{{Name: "a", URL: serverA.URL}, {Name: "b", URL: serverB.URL}}
+	resultStream := RunTargetsGenerator(done, targets, PollSchedule{})
+
+	loads := map[string]LoadAverage{}
+	for len(loads) < len(targets) {
+		result := <-resultStream
+		if result.Error != nil {
+			t.Fatalf("unexpected error in result: %v", result.Error)
+		}
+		for _, metric := range result.Metrics {
+			if metric.Source != result.Source {
+				t.Fatalf("metric source %q doesn't match result source %q", metric.Source, result.Source)
+			}
+			loads[metric.Source] = metric.Payload.Value.(LoadAverage)
+		}
+	}
+	if loads["a"] != 0.5 || loads["b"] != 1.5 {
+		t.Errorf("unexpected loads per source: %v", loads)
+	}
+}
+
+func TestTarget_LabelledOverridesPayloadSource(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `[{"type": "load_avg", "payload": {"value": 0.5}, "source": "other-host"}]`)
+	}))
+	defer server.Close()
+
+	target := Target{Name: "mine", URL: server.URL}
+	result := target.labelled(context.Background(), func(ctx context.Context) Result {
+		return target.fetch(ctx, 0)
+	})
+	if result.Error != nil {
+		t.Fatalf("unexpected error in labelled(): %v", result.Error)
+	}
+	if result.Metrics[0].Source != "mine" {
+		t.Errorf("unexpected metric source: %v != mine (observed, expected)", result.Metrics[0].Source)
+	}
+}
@@ -1,7 +1,8 @@
 package metrics
 
 import (
-	"fmt"
+	"context"
+	"math"
 	"sync"
 	"time"
 
@@ -12,29 +13,136 @@ type Handler interface {
 	Handle(metric interface{}) error
 }
 
+// SourceHandler is implemented by handlers that keep separate state per source
+// and so need each metric's source label alongside its payload
+type SourceHandler interface {
+	HandleFrom(source string, metric interface{}) error
+}
+
 // RunMetricStreamHandler pulls metrics off of the metricStream channel and
-// passes them to a handler for processing, stopping when a signal is sent over
-// the done channel
-func RunMetricStreamHandler(done <-chan interface{}, metricStream <-chan interface{}, handler Handler) {
-	for metric := range orDone(done, metricStream) {
-		if err := handler.Handle(metric); err != nil {
-			log.Error(err)
+// passes their payloads to a handler for processing, stopping when a signal is
+// sent over the done channel
+func RunMetricStreamHandler(done <-chan interface{}, metricStream <-chan Metric, handler Handler) {
+	RunMetricStreamHandlerContext(contextOf(done), metricStream, handler)
+}
+
+// RunMetricStreamHandlerContext is like RunMetricStreamHandler, but stops once
+// ctx is cancelled
+func RunMetricStreamHandlerContext(ctx context.Context, metricStream <-chan Metric, handler Handler) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case metric, ok := <-metricStream:
+			if ok == false {
+				return
+			}
+			if err := handleMetric(handler, metric); err != nil {
+				log.WithField("source", metric.Source).Error(err)
+				continue
+			}
+		}
+	}
+}
+
+// handleMetric passes the metric's payload to the handler, along with its
+// source label if the handler wants it
+func handleMetric(handler Handler, metric Metric) error {
+	if sourceHandler, ok := handler.(SourceHandler); ok {
+		return sourceHandler.HandleFrom(metric.Source, metric.Payload.Value)
+	}
+	return handler.Handle(metric.Payload.Value)
+}
+
+// PerSourceHandler keeps a separate Handler for each source, created on first
+// sight of that source by calling New
+type PerSourceHandler struct {
+	mu       sync.RWMutex
+	New      func() Handler
+	handlers map[string]Handler
+}
+
+// Handle passes an unlabelled metric to the handler for the "" source
+func (h *PerSourceHandler) Handle(metric interface{}) error {
+	return h.HandleFrom("", metric)
+}
+
+// HandleFrom passes the metric to the handler for its source
+func (h *PerSourceHandler) HandleFrom(source string, metric interface{}) error {
+	h.mu.Lock()
+	if h.handlers == nil {
+		h.handlers = make(map[string]Handler)
+	}
+	handler, ok := h.handlers[source]
+	if ok == false {
+		handler = h.New()
+		h.handlers[source] = handler
+	}
+	h.mu.Unlock()
+
+	return handler.Handle(metric)
+}
+
+// Evict drops the handler, and so the stats, kept for the given source
+func (h *PerSourceHandler) Evict(source string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	delete(h.handlers, source)
+}
+
+// Handlers returns the handler for each source seen so far
+func (h *PerSourceHandler) Handlers() map[string]Handler {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	handlers := make(map[string]Handler, len(h.handlers))
+	for source, handler := range h.handlers {
+		handlers[source] = handler
+	}
+	return handlers
+}
+
+// ErrorCounts sums the error counts of every source's handler that keeps them
+func (h *PerSourceHandler) ErrorCounts() map[ErrorKind]int64 {
+	counts := make(map[ErrorKind]int64)
+	for _, handler := range h.Handlers() {
+		counter, ok := handler.(interface{ ErrorCounts() map[ErrorKind]int64 })
+		if ok == false {
 			continue
 		}
+		for kind, n := range counter.ErrorCounts() {
+			counts[kind] += n
+		}
 	}
+	return counts
 }
 
 // LoadMetricsHandler handles all "load_avg" metrics and manages LoadStats
 type LoadMetricsHandler struct {
-	mu    sync.RWMutex
-	stats LoadStats
+	// Windows are the sliding windows to keep stats over, defaulting to
+	// DefaultLoadWindows
+	Windows []time.Duration
+
+	mu     sync.RWMutex
+	errors ErrorCounter
+	stats  LoadStats
 }
 
-// LoadStats keeps track of the min and max load seen
+// LoadStats keeps track of the min and max load seen since startup, and of
+// the loads seen within sliding time windows
 type LoadStats struct {
 	N   int
 	Min float64
 	Max float64
+	// Windows holds the stats over each sliding window, and Quantiles the
+	// estimated all-time percentiles, as of the time they were read with
+	// CurrentStats
+	Windows   []WindowStats
+	Quantiles Quantiles
+
+	window *slidingWindow
+	sketch *QuantileSketch
 }
 
 // Handle updates the LoadStats with a new metric
@@ -42,24 +150,73 @@ func (h *LoadMetricsHandler) Handle(metric interface{}) error {
 	h.mu.Lock()
 	defer h.mu.Unlock()
 
-	load, ok := metric.(float64)
+	load, ok := metric.(LoadAverage)
 	if ok == false {
-		return fmt.Errorf("failed to cast metric to float64")
+		err := &TypeMismatchError{Type: LoadAverageMetric, Expected: "LoadAverage", Value: metric}
+		h.errors.Add(err)
+		return err
+	}
+	if h.stats.window == nil {
+		windows := h.Windows
+		if windows == nil {
+			windows = DefaultLoadWindows
+		}
+		h.stats.window = newSlidingWindow(windows)
 	}
-	return h.stats.Update(load)
+	err := h.stats.Update(float64(load))
+	h.errors.Add(err)
+	return err
 }
 
-// CurrentStats returns the current LoadStats in a concurrent-safe manner
-func (h LoadMetricsHandler) CurrentStats() LoadStats {
+// CurrentStats returns the current LoadStats in a concurrent-safe manner, with
+// both the all-time and the per-window stats
+func (h *LoadMetricsHandler) CurrentStats() LoadStats {
 	h.mu.RLock()
 	defer h.mu.RUnlock()
 
-	return h.stats
+	stats := LoadStats{N: h.stats.N, Min: h.stats.Min, Max: h.stats.Max}
+	if h.stats.window != nil {
+		stats.Windows = h.stats.window.stats(time.Now())
+	}
+	if h.stats.sketch != nil {
+		stats.Quantiles = h.stats.sketch.Quantiles()
+	}
+	return stats
+}
+
+// Sketch returns a copy of the handler's quantile sketch of every load seen,
+// e.g. to merge with other sources' sketches
+func (h *LoadMetricsHandler) Sketch() *QuantileSketch {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	if h.stats.sketch == nil {
+		return newDefaultSketch()
+	}
+	return h.stats.sketch.Clone()
+}
+
+// ErrorCounts returns the number of metrics the handler has failed, by kind
+func (h *LoadMetricsHandler) ErrorCounts() map[ErrorKind]int64 {
+	return h.errors.Counts()
 }
 
 // Update determines if the newLoadMetric is the new maximum or minimum and if
 // so, changes that value
 func (s *LoadStats) Update(newLoadMetric float64) error {
+	return s.UpdateAt(newLoadMetric, time.Now())
+}
+
+// UpdateAt is like Update for a load seen at the given time, which places it
+// in the sliding windows, if any
+func (s *LoadStats) UpdateAt(newLoadMetric float64, at time.Time) error {
+	if s.window != nil {
+		s.window.add(at, newLoadMetric)
+	}
+	if s.sketch == nil {
+		s.sketch = newDefaultSketch()
+	}
+	s.sketch.Add(newLoadMetric)
 	s.N++
 	if s.N == 1 {
 		s.Min, s.Max = newLoadMetric, newLoadMetric
@@ -73,16 +230,56 @@ func (s *LoadStats) Update(newLoadMetric float64) error {
 
 // CPUMetricsHandler handles all "cpu_usage" metrics and manages CPUUsageStats
 type CPUMetricsHandler struct {
-	mu    sync.RWMutex
-	stats CPUUsageStats
+	// HalfLives are the half-lives to keep moving averages per core over,
+	// defaulting to DefaultCPUHalfLives. Half-lives of zero or less follow the
+	// latest usage
+	HalfLives []time.Duration
+	// Hotplug decides what happens when the number of cores changes,
+	// defaulting to RejectHotplug
+	Hotplug HotplugPolicy
+
+	mu     sync.RWMutex
+	errors ErrorCounter
+	stats  CPUUsageStats
+	// lastCount is the core count of the last metric handled, which under
+	// KeyByCoreOnHotplug can be below the number of cores stats are kept for
+	lastCount int
+	started   time.Time
+	epochs    []CPUEpoch
+	hotplugs  []HotplugEvent
 }
 
-// CPUUsageStats keeps track of the running average CPU usage per core
+// CPUUsageStats keeps track of the running average, spread and range of CPU
+// usage per core since startup, of moving averages per core weighted toward
+// recent usage, and of quantile sketches per core
 type CPUUsageStats struct {
 	cpuCount int
 	totals   []float64
 	N        int
 	Averages []float64
+	// Variances and StdDevs are the population variance and standard
+	// deviation per core, and Mins and Maxes the lowest and highest usage
+	Variances []float64
+	StdDevs   []float64
+	Mins      []float64
+	Maxes     []float64
+	// Overall summarises the usage across all cores
+	Overall UsageSummary
+	// EWMAs holds the moving averages per core for each half-life, as of the
+	// most recent metric
+	EWMAs []EWMA
+	// Quantiles holds the estimated percentiles per core, and
+	// OverallQuantiles those across all cores, as of the time they were read
+	// with CurrentStats
+	Quantiles        []Quantiles
+	OverallQuantiles Quantiles
+
+	halfLives []time.Duration
+	hotplug   HotplugPolicy
+	ewmas     *ewmaSet
+	sketches  []*QuantileSketch
+	welfords  []welford
+	overall   welford
 }
 
 // Handle updates the CPUUsageStats with a new metric
@@ -90,55 +287,156 @@ func (h *CPUMetricsHandler) Handle(metric interface{}) error {
 	h.mu.Lock()
 	defer h.mu.Unlock()
 
-	tmp, ok := metric.([]interface{})
+	usages, ok := metric.(CPUUsage)
 	if ok == false {
-		return fmt.Errorf("failed to cast metric to []interface{}")
+		err := &TypeMismatchError{Type: CPUUsageMetric, Expected: "CPUUsage", Value: metric}
+		h.errors.Add(err)
+		return err
+	}
+	now := time.Now()
+	from := h.lastCount
+	hotplugged := 0 < h.stats.N && len(usages) != from
+	if hotplugged && h.Hotplug == NewEpochOnHotplug {
+		h.newEpoch(now)
+	}
+	if h.stats.N == 0 {
+		h.started = now
+		h.stats.hotplug = h.Hotplug
+		h.stats.halfLives = h.HalfLives
+		if h.stats.halfLives == nil {
+			h.stats.halfLives = DefaultCPUHalfLives
+		}
 	}
-	usages, err := toFloat64Array(tmp)
+	err := h.stats.UpdateAt(usages, now)
+	h.errors.Add(err)
 	if err != nil {
 		return err
 	}
-	return h.stats.Update(usages)
+	if hotplugged {
+		h.recordHotplug(HotplugEvent{Time: now, Policy: h.Hotplug, From: from, To: len(usages)})
+	}
+	h.lastCount = len(usages)
+	return nil
 }
 
 // CurrentStats returns the current CPUUsageStats in a concurrent-safe manner
-func (h CPUMetricsHandler) CurrentStats() CPUUsageStats {
+func (h *CPUMetricsHandler) CurrentStats() CPUUsageStats {
 	h.mu.RLock()
 	defer h.mu.RUnlock()
 
+	return h.stats.snapshot()
+}
+
+// snapshot returns a copy of the stats with the quantiles and moving averages
+// filled in
+func (s *CPUUsageStats) snapshot() CPUUsageStats {
 	// TODO: evaluate use of a deep copy library
-	return CPUUsageStats{
-		cpuCount: h.stats.cpuCount,
-		totals:   append([]float64{}, h.stats.totals...),
-		N:        h.stats.N,
-		Averages: append([]float64{}, h.stats.Averages...),
+	stats := CPUUsageStats{
+		cpuCount:  s.cpuCount,
+		totals:    append([]float64{}, s.totals...),
+		N:         s.N,
+		Averages:  append([]float64{}, s.Averages...),
+		Variances: append([]float64{}, s.Variances...),
+		StdDevs:   append([]float64{}, s.StdDevs...),
+		Mins:      append([]float64{}, s.Mins...),
+		Maxes:     append([]float64{}, s.Maxes...),
+		Overall:   s.Overall,
+		Quantiles: make([]Quantiles, len(s.sketches)),
 	}
+	if s.ewmas != nil {
+		stats.EWMAs = s.ewmas.snapshot()
+	}
+	overall := newDefaultSketch()
+	for i, sketch := range s.sketches {
+		stats.Quantiles[i] = sketch.Quantiles()
+		overall.Merge(sketch)
+	}
+	stats.OverallQuantiles = overall.Quantiles()
+	return stats
+}
+
+// Sketches returns copies of the handler's per-core quantile sketches, e.g.
+// to merge with other sources' sketches
+func (h *CPUMetricsHandler) Sketches() []*QuantileSketch {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	sketches := make([]*QuantileSketch, len(h.stats.sketches))
+	for i, sketch := range h.stats.sketches {
+		sketches[i] = sketch.Clone()
+	}
+	return sketches
+}
+
+// ErrorCounts returns the number of metrics the handler has failed, by kind
+func (h *CPUMetricsHandler) ErrorCounts() map[ErrorKind]int64 {
+	return h.errors.Counts()
 }
 
 // Update calculates the new average CPU usage for each core
 func (s *CPUUsageStats) Update(usages []float64) error {
+	return s.UpdateAt(usages, time.Now())
+}
+
+// UpdateAt is like Update for usages seen at the given time, which weights
+// them in the moving averages, if any
+func (s *CPUUsageStats) UpdateAt(usages []float64, at time.Time) error {
 	if 0 < s.N && len(usages) != s.cpuCount {
-		// Assumption: constant CPU count for all requests
-		return fmt.Errorf("invalid length of usages array: expected %v, got %v", s.cpuCount, len(usages))
+		switch s.hotplug {
+		case ResizeOnHotplug:
+			s.resize(len(usages))
+		case KeyByCoreOnHotplug:
+			if s.cpuCount < len(usages) {
+				s.resize(len(usages))
+			}
+		default:
+			// Assumption: constant CPU count for all requests
+			return &CPUCountMismatchError{Expected: s.cpuCount, Observed: len(usages)}
+		}
 	}
 
 	s.N++
 	if s.N == 1 {
-		s.cpuCount = len(usages)
-		s.totals = make([]float64, s.cpuCount)
-		s.Averages = make([]float64, s.cpuCount)
+		if 0 < len(s.halfLives) {
+			s.ewmas = newEWMASet(s.halfLives)
+		}
+		s.resize(len(usages))
+	}
+	if s.ewmas != nil {
+		s.ewmas.add(at, usages)
 	}
 	for i, usage := range usages {
+		// Cores may have joined since the first metric, so each keeps its
+		// own count
+		s.welfords[i].add(usage)
 		s.totals[i] += usage
-		s.Averages[i] = s.totals[i] / float64(s.N)
+		s.Averages[i] = s.totals[i] / float64(s.welfords[i].n)
+		s.sketches[i].Add(usage)
+		s.Variances[i] = s.welfords[i].variance()
+		s.StdDevs[i] = s.welfords[i].stdDev()
+		s.overall.add(usage)
+		if s.welfords[i].n == 1 {
+			s.Mins[i], s.Maxes[i] = usage, usage
+		}
+		s.Mins[i] = math.Min(s.Mins[i], usage)
+		s.Maxes[i] = math.Max(s.Maxes[i], usage)
+		if s.overall.n == 1 {
+			s.Overall.Min, s.Overall.Max = usage, usage
+		}
+		s.Overall.Min = math.Min(s.Overall.Min, usage)
+		s.Overall.Max = math.Max(s.Overall.Max, usage)
 	}
+	s.Overall.Mean = s.overall.mean
+	s.Overall.Variance = s.overall.variance()
+	s.Overall.StdDev = s.overall.stdDev()
 	return nil
 }
 
 // KernelMetricsHandler handles all "last_kernel_upgrade" metrics and manages KernelUpgradeStats
 type KernelMetricsHandler struct {
-	mu    sync.RWMutex
-	stats KernelUpgradeStats
+	mu     sync.RWMutex
+	errors ErrorCounter
+	stats  KernelUpgradeStats
 }
 
 // KernelUpgradeStats keeps track of the most recent timestamp seen
@@ -152,29 +450,43 @@ func (h *KernelMetricsHandler) Handle(metric interface{}) error {
 	h.mu.Lock()
 	defer h.mu.Unlock()
 
-	timestamp, ok := metric.(string)
+	upgrade, ok := metric.(KernelUpgrade)
 	if ok == false {
-		return fmt.Errorf("failed to cast metric to string")
+		err := &TypeMismatchError{Type: LastKernelUpgradeMetric, Expected: "KernelUpgrade", Value: metric}
+		h.errors.Add(err)
+		return err
 	}
-	return h.stats.Update(timestamp)
+	err := h.stats.UpdateTime(upgrade.Time)
+	h.errors.Add(err)
+	return err
 }
 
 // CurrentStats returns the current KernelUpgradeStats in a concurrent-safe manner
-func (h KernelMetricsHandler) CurrentStats() KernelUpgradeStats {
+func (h *KernelMetricsHandler) CurrentStats() KernelUpgradeStats {
 	h.mu.RLock()
 	defer h.mu.RUnlock()
 
 	return h.stats
 }
 
+// ErrorCounts returns the number of metrics the handler has failed, by kind
+func (h *KernelMetricsHandler) ErrorCounts() map[ErrorKind]int64 {
+	return h.errors.Counts()
+}
+
 // Update takes a new timestamp string and compares it against the current
 // most recent upgrade time, replacing it if it's more recent
 func (s *KernelUpgradeStats) Update(newTimestamp string) error {
 	newTime, err := time.Parse(time.RFC3339, newTimestamp)
 	if err != nil {
-		return fmt.Errorf("unable to parse newTimestamp: %v", err)
+		return &TimestampError{Timestamp: newTimestamp, Err: err}
 	}
+	return s.UpdateTime(newTime)
+}
 
+// UpdateTime compares an already parsed upgrade time against the current most
+// recent upgrade time, replacing it if it's more recent
+func (s *KernelUpgradeStats) UpdateTime(newTime time.Time) error {
 	s.N++
 	if newTime.After(s.MostRecent) {
 		// Assumption: "keep track of the most recent timestamp" means comparing timestamps rather
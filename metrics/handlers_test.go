@@ -1,6 +1,7 @@
 package metrics
 
 import (
+	"errors"
 	"fmt"
 	"math/rand"
 	"reflect"
@@ -216,3 +217,46 @@ func TestKernelUpgradeStats_Update(t *testing.T) {
 		}
 	})
 }
+
+func TestPerSourceHandler(t *testing.T) {
+	handler := &PerSourceHandler{New: func() Handler { return &LoadMetricsHandler{} }}
+	metricStream := make(chan Metric, 3)
+	metricStream <- Metric{Type: LoadAverageMetric, Payload: MetricPayload{Value: LoadAverage(0.5)}, Source: "a"}
+	metricStream <- Metric{Type: LoadAverageMetric, Payload: MetricPayload{Value: LoadAverage(1.5)}, Source: "b"}
+	metricStream <- Metric{Type: LoadAverageMetric, Payload: MetricPayload{Value: LoadAverage(2.5)}, Source: "a"}
+	close(metricStream)
+	RunMetricStreamHandler(make(chan interface{}), metricStream, handler)
+
+	handlers := handler.Handlers()
+	if len(handlers) != 2 {
+		t.Fatalf("unexpected number of sources: %v != 2 (observed, expected)", len(handlers))
+	}
+	statsA := handlers["a"].(*LoadMetricsHandler).CurrentStats()
+	if statsA.N != 2 || statsA.Min != 0.5 || statsA.Max != 2.5 {
+		t.Errorf("unexpected stats for source a: %+v", statsA)
+	}
+	statsB := handlers["b"].(*LoadMetricsHandler).CurrentStats()
+	if statsB.N != 1 || statsB.Min != 1.5 || statsB.Max != 1.5 {
+		t.Errorf("unexpected stats for source b: %+v", statsB)
+	}
+}
+
+func TestHandlers_ErrorCounts(t *testing.T) {
+	handler := &PerSourceHandler{New: func() Handler { return &CPUMetricsHandler{} }}
+	handler.HandleFrom("a", CPUUsage{10, 20})
+	if err := handler.HandleFrom("a", CPUUsage{10}); !errors.Is(err, ErrCPUCountMismatch) {
+		t.Errorf("unexpected error: %v != %v (observed, expected)", err, ErrCPUCountMismatch)
+	}
+	if err := handler.HandleFrom("b", LoadAverage(0.5)); !errors.Is(err, ErrTypeMismatch) {
+		t.Errorf("unexpected error: %v != %v (observed, expected)", err, ErrTypeMismatch)
+	}
+
+	expected := map[ErrorKind]int64{CPUCountMismatchKind: 1}
+	if observed := handler.Handlers()["a"].(*CPUMetricsHandler).ErrorCounts(); !reflect.DeepEqual(observed, expected) {
+		t.Errorf("unexpected counts for source a: %v != %v (observed, expected)", observed, expected)
+	}
+	expected = map[ErrorKind]int64{CPUCountMismatchKind: 1, TypeMismatchKind: 1}
+	if observed := handler.ErrorCounts(); !reflect.DeepEqual(observed, expected) {
+		t.Errorf("unexpected counts across sources: %v != %v (observed, expected)", observed, expected)
+	}
+}
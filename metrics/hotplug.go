@@ -0,0 +1,130 @@
+package metrics
+
+import (
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// maxCPUEpochs bounds the past epochs and hotplug events a CPUMetricsHandler
+// keeps, dropping the oldest, so a flapping core count can't grow them forever
+const maxCPUEpochs = 16
+
+// HotplugPolicy decides what a CPUMetricsHandler does when a cpu_usage metric
+// reports a different number of cores than earlier ones, e.g. after a VM resize
+type HotplugPolicy int
+
+const (
+	// RejectHotplug fails metrics with a different core count than the first
+	RejectHotplug HotplugPolicy = iota
+	// NewEpochOnHotplug sets the current stats aside as a past epoch, still
+	// available from Epochs, and starts over with the new core count
+	NewEpochOnHotplug
+	// ResizeOnHotplug keeps the stats of the cores still reported, starts
+	// added cores from scratch and drops removed ones
+	ResizeOnHotplug
+	// KeyByCoreOnHotplug keeps stats for every core index seen. Removed cores
+	// keep their stats as they were, and pick up from them if they return
+	KeyByCoreOnHotplug
+)
+
+func (p HotplugPolicy) String() string {
+	switch p {
+	case RejectHotplug:
+		return "reject"
+	case NewEpochOnHotplug:
+		return "new-epoch"
+	case ResizeOnHotplug:
+		return "resize"
+	case KeyByCoreOnHotplug:
+		return "key-by-core"
+	}
+	return "unknown"
+}
+
+// HotplugEvent records a change in the number of cores a CPUMetricsHandler
+// was sent, and how it was handled
+type HotplugEvent struct {
+	Time   time.Time
+	Policy HotplugPolicy
+	From   int
+	To     int
+}
+
+// CPUEpoch is the stats a CPUMetricsHandler kept between two core count
+// changes under NewEpochOnHotplug
+type CPUEpoch struct {
+	Started time.Time
+	Ended   time.Time
+	Stats   CPUUsageStats
+}
+
+// Epochs returns the past epochs of the handler, oldest first
+func (h *CPUMetricsHandler) Epochs() []CPUEpoch {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	epochs := make([]CPUEpoch, len(h.epochs))
+	for i, epoch := range h.epochs {
+		epochs[i] = CPUEpoch{Started: epoch.Started, Ended: epoch.Ended, Stats: epoch.Stats.snapshot()}
+	}
+	return epochs
+}
+
+// Hotplugs returns the core count changes the handler has handled, oldest first
+func (h *CPUMetricsHandler) Hotplugs() []HotplugEvent {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	return append([]HotplugEvent{}, h.hotplugs...)
+}
+
+// newEpoch sets the current stats aside as a past epoch ended at the given time
+func (h *CPUMetricsHandler) newEpoch(at time.Time) {
+	h.epochs = append(h.epochs, CPUEpoch{Started: h.started, Ended: at, Stats: h.stats})
+	if maxCPUEpochs < len(h.epochs) {
+		h.epochs = h.epochs[1:]
+	}
+	h.stats = CPUUsageStats{}
+}
+
+// recordHotplug keeps and logs a handled core count change
+func (h *CPUMetricsHandler) recordHotplug(event HotplugEvent) {
+	h.hotplugs = append(h.hotplugs, event)
+	if maxCPUEpochs < len(h.hotplugs) {
+		h.hotplugs = h.hotplugs[1:]
+	}
+	log.WithFields(log.Fields{
+		"policy": event.Policy,
+		"from":   event.From,
+		"to":     event.To,
+	}).Warn("CPU count changed")
+}
+
+// resize adds cores without any usage yet or drops the highest cores to keep
+// stats for cpuCount cores
+func (s *CPUUsageStats) resize(cpuCount int) {
+	s.cpuCount = cpuCount
+	s.totals = resizeSlice(s.totals, cpuCount)
+	s.Averages = resizeSlice(s.Averages, cpuCount)
+	s.Variances = resizeSlice(s.Variances, cpuCount)
+	s.StdDevs = resizeSlice(s.StdDevs, cpuCount)
+	s.Mins = resizeSlice(s.Mins, cpuCount)
+	s.Maxes = resizeSlice(s.Maxes, cpuCount)
+	s.welfords = resizeSlice(s.welfords, cpuCount)
+	for len(s.sketches) < cpuCount {
+		s.sketches = append(s.sketches, newDefaultSketch())
+	}
+	s.sketches = s.sketches[:cpuCount]
+	if s.ewmas != nil {
+		s.ewmas.resize(cpuCount)
+	}
+}
+
+// resizeSlice pads values with zero values or truncates them to n
+func resizeSlice[T any](values []T, n int) []T {
+	if n <= len(values) {
+		return values[:n]
+	}
+	return append(values, make([]T, n-len(values))...)
+}
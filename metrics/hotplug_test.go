@@ -0,0 +1,98 @@
+package metrics
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestCPUMetricsHandler_Hotplug(t *testing.T) {
+	testCases := []struct {
+		Policy           HotplugPolicy
+		ExpectedN        int
+		ExpectedAverages []float64
+		ExpectedEpochs   int
+	}{
+		// Two cores at 10 and 20, then three at 40, 50 and 60, then one at 70
+		// twice, which is a single change in core count
+		{Policy: NewEpochOnHotplug, ExpectedN: 2, ExpectedAverages: []float64{70}, ExpectedEpochs: 2},
+		{Policy: ResizeOnHotplug, ExpectedN: 4, ExpectedAverages: []float64{47.5}},
+		{Policy: KeyByCoreOnHotplug, ExpectedN: 4, ExpectedAverages: []float64{47.5, 35, 60}},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.Policy.String(), func(t *testing.T) {
+			handler := &CPUMetricsHandler{Hotplug: testCase.Policy}
+			for _, usages := range []CPUUsage{{10, 20}, {40, 50, 60}, {70}, {70}} {
+				if err := handler.Handle(usages); err != nil {
+					t.Fatalf("unexpected error in handler.Handle(): %v", err)
+				}
+			}
+
+			stats := handler.CurrentStats()
+			if stats.N != testCase.ExpectedN {
+				t.Errorf("unexpected stats.N: %v != %v (observed, expected)", stats.N, testCase.ExpectedN)
+			}
+			if !reflect.DeepEqual(stats.Averages, testCase.ExpectedAverages) {
+				t.Errorf("unexpected stats.Averages: %v != %v (observed, expected)", stats.Averages, testCase.ExpectedAverages)
+			}
+			if len(stats.EWMAs[0].Values) != len(testCase.ExpectedAverages) || len(stats.Quantiles) != len(testCase.ExpectedAverages) {
+				t.Errorf("unexpected per-core stats: %+v", stats)
+			}
+			if epochs := handler.Epochs(); len(epochs) != testCase.ExpectedEpochs {
+				t.Errorf("unexpected number of epochs: %v != %v (observed, expected)", len(epochs), testCase.ExpectedEpochs)
+			}
+
+			hotplugs := handler.Hotplugs()
+			if len(hotplugs) != 2 {
+				t.Fatalf("unexpected number of hotplugs: %v != 2 (observed, expected)", len(hotplugs))
+			}
+			expected := HotplugEvent{Time: hotplugs[1].Time, Policy: testCase.Policy, From: 3, To: 1}
+			if hotplugs[1] != expected {
+				t.Errorf("unexpected hotplug: %+v != %+v (observed, expected)", hotplugs[1], expected)
+			}
+		})
+	}
+
+	// Special bad cases
+	t.Run("Reject", func(t *testing.T) {
+		handler := &CPUMetricsHandler{}
+		handler.Handle(CPUUsage{10, 20})
+		if err := handler.Handle(CPUUsage{10}); !errors.Is(err, ErrCPUCountMismatch) {
+			t.Errorf("unexpected error: %v != %v (observed, expected)", err, ErrCPUCountMismatch)
+		}
+		if len(handler.Hotplugs()) != 0 || len(handler.Epochs()) != 0 {
+			t.Errorf("unexpected hotplug recorded for a rejected metric")
+		}
+	})
+}
+
+func TestCPUMetricsHandler_Epochs(t *testing.T) {
+	handler := &CPUMetricsHandler{Hotplug: NewEpochOnHotplug}
+	handler.Handle(CPUUsage{10, 20})
+	handler.Handle(CPUUsage{30, 40})
+	handler.Handle(CPUUsage{50})
+
+	epochs := handler.Epochs()
+	if len(epochs) != 1 {
+		t.Fatalf("unexpected number of epochs: %v != 1 (observed, expected)", len(epochs))
+	}
+	if epochs[0].Ended.Before(epochs[0].Started) {
+		t.Errorf("unexpected epoch bounds: ended %v before started %v", epochs[0].Ended, epochs[0].Started)
+	}
+	previous := epochs[0].Stats
+	if previous.N != 2 || !reflect.DeepEqual(previous.Averages, []float64{20, 30}) || previous.Quantiles[1].P50 == 0 {
+		t.Errorf("unexpected stats for the previous epoch: %+v", previous)
+	}
+	previous.Averages[0] = 0
+	if handler.Epochs()[0].Stats.Averages[0] != 20 {
+		t.Errorf("internal stats modified by external code")
+	}
+
+	// Only the most recent epochs are kept
+	for i := 0; i < 2*maxCPUEpochs; i++ {
+		handler.Handle(make(CPUUsage, 1+i%2))
+	}
+	if len(handler.Epochs()) != maxCPUEpochs || len(handler.Hotplugs()) != maxCPUEpochs {
+		t.Errorf("unexpected number of epochs and hotplugs kept: %v and %v != %v (observed, expected)", len(handler.Epochs()), len(handler.Hotplugs()), maxCPUEpochs)
+	}
+}
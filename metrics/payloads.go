@@ -0,0 +1,113 @@
+package metrics
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// LoadAverage is the decoded payload of a "load_avg" metric
+type LoadAverage float64
+
+// CPUUsage is the decoded payload of a "cpu_usage" metric, one usage per core
+type CPUUsage []float64
+
+// KernelUpgrade is the decoded payload of a "last_kernel_upgrade" metric
+type KernelUpgrade struct {
+	time.Time
+}
+
+// PayloadDecoder decodes the raw JSON value of a metric's payload into its
+// concrete type, returning an error if the value has the wrong shape
+type PayloadDecoder func(raw json.RawMessage) (interface{}, error)
+
+var (
+	payloadDecodersMu sync.RWMutex
+	payloadDecoders   = map[MetricType]PayloadDecoder{
+		LoadAverageMetric:       decodeLoadAverage,
+		CPUUsageMetric:          decodeCPUUsage,
+		LastKernelUpgradeMetric: decodeKernelUpgrade,
+	}
+)
+
+// RegisterPayloadDecoder sets the decoder used for metrics of the given type,
+// replacing any existing one. Metrics of types without a decoder keep their
+// payload as generic JSON values
+func RegisterPayloadDecoder(t MetricType, decoder PayloadDecoder) {
+	payloadDecodersMu.Lock()
+	defer payloadDecodersMu.Unlock()
+
+	payloadDecoders[t] = decoder
+}
+
+func lookupPayloadDecoder(t MetricType) (PayloadDecoder, bool) {
+	payloadDecodersMu.RLock()
+	defer payloadDecodersMu.RUnlock()
+
+	decoder, ok := payloadDecoders[t]
+	return decoder, ok
+}
+
+// UnmarshalJSON decodes a metric, using the payload decoder registered for its
+// type so that the payload's value has a concrete type
+func (m *Metric) UnmarshalJSON(data []byte) error {
+	var raw struct {
+		Type    MetricType `json:"type"`
+		Payload struct {
+			Value json.RawMessage `json:"value"`
+		} `json:"payload"`
+		Source string `json:"source"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+
+	var value interface{}
+	if decoder, ok := lookupPayloadDecoder(raw.Type); ok {
+		var err error
+		if value, err = decoder(raw.Payload.Value); err != nil {
+			return &DecodeError{Type: raw.Type, Err: err}
+		}
+	} else if raw.Payload.Value != nil {
+		if err := json.Unmarshal(raw.Payload.Value, &value); err != nil {
+			return err
+		}
+	}
+
+	m.Type = raw.Type
+	m.Payload = MetricPayload{Value: value}
+	m.Source = raw.Source
+	return nil
+}
+
+func decodeLoadAverage(raw json.RawMessage) (interface{}, error) {
+	var load float64
+	if err := json.Unmarshal(raw, &load); err != nil {
+		return nil, err
+	}
+	return LoadAverage(load), nil
+}
+
+func decodeCPUUsage(raw json.RawMessage) (interface{}, error) {
+	var usages []float64
+	if err := json.Unmarshal(raw, &usages); err != nil {
+		return nil, err
+	}
+	if len(usages) == 0 {
+		return nil, fmt.Errorf("no cores reported")
+	}
+	return CPUUsage(usages), nil
+}
+
+func decodeKernelUpgrade(raw json.RawMessage) (interface{}, error) {
+	var timestamp string
+	if err := json.Unmarshal(raw, &timestamp); err != nil {
+		return nil, err
+	}
+	upgraded, err := time.Parse(time.RFC3339, timestamp)
+	if err != nil {
+		return nil, &TimestampError{Timestamp: timestamp, Err: err}
+	}
+	return KernelUpgrade{upgraded}, nil
+}
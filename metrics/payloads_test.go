@@ -0,0 +1,90 @@
+package metrics
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestUnmarshalMetricsBatch_TypedPayloads(t *testing.T) {
+	data := []byte(`[
+		{"type": "load_avg", "payload": {"value": 0.5}},
+		{"type": "cpu_usage", "payload": {"value": [12.5, 50]}},
+		{"type": "last_kernel_upgrade", "payload": {"value": "2020-04-02T11:38:29.886438475-05:00"}},
+		{"type": "unknown", "payload": {"value": {"a": 1}}}
+	]`)
+	metrics, err := unmarshalMetricsBatch(data)
+	if err != nil {
+		t.Fatalf("unexpected error in unmarshalMetricsBatch(): %v", err)
+	}
+
+	upgraded, _ := time.Parse(time.RFC3339, "2020-04-02T11:38:29.886438475-05:00")
+	expected := []interface{}{
+		LoadAverage(0.5),
+		CPUUsage{12.5, 50},
+		KernelUpgrade{upgraded},
+		map[string]interface{}{"a": 1.0},
+	}
+	for i, metric := range metrics {
+		if !reflect.DeepEqual(metric.Payload.Value, expected[i]) {
+			t.Errorf("unexpected payload for %v: %#v != %#v (observed, expected)", metric.Type, metric.Payload.Value, expected[i])
+		}
+	}
+
+	// Special bad cases
+	badCases := map[string]string{
+		"LoadNotANumber":     `[{"type": "load_avg", "payload": {"value": "high"}}]`,
+		"CPUNotAnArray":      `[{"type": "cpu_usage", "payload": {"value": 12.5}}]`,
+		"CPUMixedTypes":      `[{"type": "cpu_usage", "payload": {"value": [12.5, "50"]}}]`,
+		"CPUNoCores":         `[{"type": "cpu_usage", "payload": {"value": []}}]`,
+		"KernelBadTimestamp": `[{"type": "last_kernel_upgrade", "payload": {"value": "NO. BAD TIMESTAMP. BAD."}}]`,
+	}
+	for name, data := range badCases {
+		t.Run(name, func(t *testing.T) {
+			if _, err := unmarshalMetricsBatch([]byte(data)); err == nil {
+				t.Fatal("expected error in unmarshalMetricsBatch(), got none")
+			}
+		})
+	}
+}
+
+func TestTypedPayloads_RoundTrip(t *testing.T) {
+	upgraded := time.Date(2020, 4, 2, 11, 38, 29, 0, time.UTC)
+	batch := []Metric{
+		{Type: LoadAverageMetric, Payload: MetricPayload{Value: LoadAverage(0.5)}},
+		{Type: CPUUsageMetric, Payload: MetricPayload{Value: CPUUsage{1, 2}}},
+		{Type: LastKernelUpgradeMetric, Payload: MetricPayload{Value: KernelUpgrade{upgraded}}},
+	}
+	data, err := json.Marshal(batch)
+	if err != nil {
+		t.Fatalf("unexpected error in json.Marshal(): %v", err)
+	}
+	decoded, err := unmarshalMetricsBatch(data)
+	if err != nil {
+		t.Fatalf("unexpected error in unmarshalMetricsBatch(): %v", err)
+	}
+	if !reflect.DeepEqual(decoded, batch) {
+		t.Errorf("unexpected round trip: %v != %v (observed, expected)", decoded, batch)
+	}
+}
+
+func TestRegisterPayloadDecoder(t *testing.T) {
+	custom := MetricType("custom")
+	RegisterPayloadDecoder(custom, func(raw json.RawMessage) (interface{}, error) {
+		return string(raw), nil
+	})
+	defer func() {
+		payloadDecodersMu.Lock()
+		delete(payloadDecoders, custom)
+		payloadDecodersMu.Unlock()
+	}()
+
+	metrics, err := unmarshalMetricsBatch([]byte(`[{"type": "custom", "payload": {"value": [1]}}]`))
+	if err != nil {
+		t.Fatalf("unexpected error in unmarshalMetricsBatch(): %v", err)
+	}
+	if metrics[0].Payload.Value != "[1]" {
+		t.Errorf("custom decoder not used: %#v", metrics[0].Payload.Value)
+	}
+}
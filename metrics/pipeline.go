@@ -0,0 +1,252 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// ErrDrainTimeout is returned by Pipeline.Run when in-flight metrics didn't
+// make it through the dispatcher and handlers within the drain timeout
+var ErrDrainTimeout = errors.New("timed out draining pipeline")
+
+// DefaultDrainTimeout bounds how long a Pipeline waits to drain once stopped
+var DefaultDrainTimeout = 10 * time.Second
+
+// Transform is a stage applied to the merged Result stream before dispatch,
+// e.g. built from the stage package's Map and Filter
+type Transform func(ctx context.Context, resultStream <-chan Result) <-chan Result
+
+// Pipeline wires sources, transforms, a dispatcher, handlers and sinks into a
+// single unit that can be run and stopped. A Pipeline runs once
+type Pipeline struct {
+	sources      []Source
+	transforms   []Transform
+	dispatcher   *ResultStreamDispatcher
+	handlers     []pipelineHandler
+	deadLetters  DeadLetterSink
+	errors       *ErrorStream
+	sinks        []io.Closer
+	drainTimeout time.Duration
+
+	mu       sync.Mutex
+	running  bool
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// pipelineHandler is a Handler waiting to be subscribed when the Pipeline runs
+type pipelineHandler struct {
+	metricType MetricType
+	handler    Handler
+	opts       *SubscriptionOptions
+}
+
+// Option configures a Pipeline
+type Option func(*Pipeline)
+
+// WithSources adds sources of Results to the pipeline
+func WithSources(sources ...Source) Option {
+	return func(p *Pipeline) {
+		p.sources = append(p.sources, sources...)
+	}
+}
+
+// WithTransforms adds transforms, applied in order to the merged Result stream
+func WithTransforms(transforms ...Transform) Option {
+	return func(p *Pipeline) {
+		p.transforms = append(p.transforms, transforms...)
+	}
+}
+
+// WithDispatcher uses the given dispatcher, so that callers can keep hold of
+// it, e.g. as a Backpressure gauge or to read its SubscriptionStats
+func WithDispatcher(dispatcher *ResultStreamDispatcher) Option {
+	return func(p *Pipeline) {
+		p.dispatcher = dispatcher
+	}
+}
+
+// WithHandler subscribes the handler to metrics of the given type, using the
+// dispatcher's default buffer size
+func WithHandler(t MetricType, handler Handler) Option {
+	return func(p *Pipeline) {
+		p.handlers = append(p.handlers, pipelineHandler{metricType: t, handler: handler})
+	}
+}
+
+// WithSubscription is like WithHandler, but with its own subscription options
+func WithSubscription(t MetricType, handler Handler, opts SubscriptionOptions) Option {
+	return func(p *Pipeline) {
+		p.handlers = append(p.handlers, pipelineHandler{metricType: t, handler: handler, opts: &opts})
+	}
+}
+
+// WithDeadLetters routes undecodable batches, unsubscribed metrics and
+// metrics that fail handling to sink. The sink isn't closed by the Pipeline
+// unless also given to WithSinks
+func WithDeadLetters(sink DeadLetterSink) Option {
+	return func(p *Pipeline) {
+		p.deadLetters = sink
+	}
+}
+
+// WithErrors publishes an ErrorEvent to errs for every failure at any stage,
+// rather than logging it. The stream is closed once the pipeline has drained
+func WithErrors(errs *ErrorStream) Option {
+	return func(p *Pipeline) {
+		p.errors = errs
+	}
+}
+
+// WithSinks closes (flushing) each sink once the pipeline has drained
+func WithSinks(sinks ...io.Closer) Option {
+	return func(p *Pipeline) {
+		p.sinks = append(p.sinks, sinks...)
+	}
+}
+
+// WithDrainTimeout bounds how long Run waits to drain once stopped, or waits
+// indefinitely if zero
+func WithDrainTimeout(timeout time.Duration) Option {
+	return func(p *Pipeline) {
+		p.drainTimeout = timeout
+	}
+}
+
+// NewPipeline returns a Pipeline configured by the given options
+func NewPipeline(opts ...Option) *Pipeline {
+	p := &Pipeline{
+		dispatcher:   &ResultStreamDispatcher{},
+		drainTimeout: DefaultDrainTimeout,
+		stop:         make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(p)
+	}
+	if p.deadLetters != nil {
+		p.dispatcher.DeadLetters = p.deadLetters
+	}
+	if p.errors != nil {
+		p.dispatcher.Errors = p.errors
+	}
+	return p
+}
+
+// Dispatcher returns the pipeline's dispatcher
+func (p *Pipeline) Dispatcher() *ResultStreamDispatcher {
+	return p.dispatcher
+}
+
+// Run starts the pipeline and blocks until it's stopped, its sources run out
+// or ctx is cancelled. Once stopped or out of input, Run stops the sources and
+// waits for metrics already produced to drain through the dispatcher and
+// handlers before closing the sinks, returning ErrDrainTimeout if that takes
+// too long. Cancelling ctx aborts everything immediately, dropping in-flight
+// metrics, and Run returns ctx's error. Either way, the sinks are only closed
+// once the dispatcher and handlers have exited, so a handler busy with a
+// metric holds up Run until it's done
+func (p *Pipeline) Run(ctx context.Context) error {
+	p.mu.Lock()
+	if p.running {
+		p.mu.Unlock()
+		return fmt.Errorf("pipeline already run")
+	}
+	p.running = true
+	p.mu.Unlock()
+
+	runCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	resultStream, err := StartSourcesContext(runCtx, p.sources...)
+	if err != nil {
+		return p.closeSinks(err)
+	}
+	for _, transform := range p.transforms {
+		resultStream = transform(runCtx, resultStream)
+	}
+
+	var handlersWg sync.WaitGroup
+	for _, h := range p.handlers {
+		handler := h.handler
+		if p.dispatcher.DeadLetters != nil {
+			handler = &DeadLetterHandler{Handler: handler, Type: h.metricType, Sink: p.dispatcher.DeadLetters}
+		}
+		if p.errors != nil {
+			handler = &ErrorReportingHandler{Handler: handler, Type: h.metricType, Errors: p.errors}
+		}
+		var stream <-chan Metric
+		if h.opts != nil {
+			stream = p.dispatcher.SubscribeWith(h.metricType, *h.opts).Metrics()
+		} else {
+			stream = p.dispatcher.Subscribe(h.metricType)
+		}
+		handlersWg.Add(1)
+		go func() {
+			defer handlersWg.Done()
+			RunMetricStreamHandlerContext(runCtx, stream, handler)
+		}()
+	}
+	dispatched := make(chan struct{})
+	go func() {
+		defer close(dispatched)
+		p.dispatcher.RunContext(runCtx, resultStream)
+	}()
+
+	select {
+	case <-p.stop:
+	case <-dispatched:
+	case <-ctx.Done():
+	}
+
+	// Stop producing, let the dispatcher finish what's already been produced,
+	// then close the subscriptions so the handlers exit once they've drained
+	for _, source := range p.sources {
+		source.Stop()
+	}
+	drained := make(chan struct{})
+	go func() {
+		defer close(drained)
+		<-dispatched
+		p.dispatcher.Close()
+		handlersWg.Wait()
+	}()
+	var timeout <-chan time.Time
+	if 0 < p.drainTimeout {
+		timer := time.NewTimer(p.drainTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case <-drained:
+	case <-timeout:
+		err = ErrDrainTimeout
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	// Abandon what's left, but let the handlers finish before their sinks close
+	cancel()
+	<-drained
+	if p.errors != nil {
+		p.errors.Close()
+	}
+	return p.closeSinks(err)
+}
+
+// Stop signals a running pipeline to stop and drain. It's safe to call more
+// than once, and before Run
+func (p *Pipeline) Stop() {
+	p.stopOnce.Do(func() { close(p.stop) })
+}
+
+// closeSinks closes every sink, returning err or else the first failure
+func (p *Pipeline) closeSinks(err error) error {
+	for _, sink := range p.sinks {
+		if closeErr := sink.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
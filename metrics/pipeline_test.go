@@ -0,0 +1,188 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sambarnes/demoware-consumer/stage"
+)
+
+// recordingHandler keeps every payload it's given, after waiting for delay
+type recordingHandler struct {
+	mu       sync.Mutex
+	payloads []interface{}
+	block    chan struct{}
+	delay    time.Duration
+}
+
+func (h *recordingHandler) Handle(metric interface{}) error {
+	if h.block != nil {
+		<-h.block
+	}
+	time.Sleep(h.delay)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.payloads = append(h.payloads, metric)
+	return nil
+}
+
+func (h *recordingHandler) handled() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.payloads)
+}
+
+// closeCounter is a sink counting how often it's closed
+type closeCounter struct{ closed int }
+
+func (c *closeCounter) Close() error {
+	c.closed++
+	return nil
+}
+
+func TestPipeline_RunsUntilSourcesFinish(t *testing.T) {
+	batches := `[{"type": "load_avg", "payload": {"value": 0.5}}, {"type": "cpu_usage", "payload": {"value": [1, 2]}}]
+[{"type": "load_avg", "payload": {"value": 1.5}}]
+`
+	loads, cpus := &recordingHandler{}, &recordingHandler{}
+	sink := &closeCounter{}
+	pipeline := NewPipeline(
+		WithSources(&ReaderSource{Name: "test", Reader: strings.NewReader(batches)}),
+		WithHandler(LoadAverageMetric, loads),
+		WithSubscription(CPUUsageMetric, cpus, SubscriptionOptions{BufferSize: 1, Overflow: DropOldest}),
+		WithSinks(sink),
+	)
+	if err := pipeline.Run(context.Background()); err != nil {
+		t.Fatalf("unexpected error from Run: %v", err)
+	}
+	if loads.handled() != 2 || cpus.handled() != 1 {
+		t.Errorf("unexpected handled counts: %v, %v != 2, 1 (observed, expected)", loads.handled(), cpus.handled())
+	}
+	if sink.closed != 1 {
+		t.Errorf("unexpected sink closes: %v != 1 (observed, expected)", sink.closed)
+	}
+	if err := pipeline.Run(context.Background()); err == nil {
+		t.Error("expected error running a pipeline twice")
+	}
+}
+
+func TestPipeline_Transforms(t *testing.T) {
+	batches := `[{"type": "load_avg", "payload": {"value": 0.5}}]
+[{"type": "load_avg", "payload": {"value": 1.5}}]
+`
+	keepHighLoad := func(ctx context.Context, resultStream <-chan Result) <-chan Result {
+		return stage.Filter(ctx, resultStream, func(result Result) bool {
+			return result.Metrics[0].Payload.Value.(LoadAverage) > 1
+		})
+	}
+	loads := &recordingHandler{}
+	pipeline := NewPipeline(
+		WithSources(&ReaderSource{Name: "test", Reader: strings.NewReader(batches)}),
+		WithTransforms(keepHighLoad),
+		WithHandler(LoadAverageMetric, loads),
+	)
+	if err := pipeline.Run(context.Background()); err != nil {
+		t.Fatalf("unexpected error from Run: %v", err)
+	}
+	if len(loads.payloads) != 1 || loads.payloads[0] != LoadAverage(1.5) {
+		t.Errorf("unexpected payloads: %v != [1.5] (observed, expected)", loads.payloads)
+	}
+}
+
+func TestPipeline_StopDrains(t *testing.T) {
+	var mu sync.Mutex
+	served := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		served++
+		mu.Unlock()
+		w.Write([]byte(`[{"type": "load_avg", "payload": {"value": 0.5}}]`))
+	}))
+	defer server.Close()
+
+	// A slow handler leaves batches queued in the source's buffer when stopped
+	loads := &recordingHandler{delay: time.Millisecond}
+	pipeline := NewPipeline(
+		WithSources(&HTTPSource{Targets: []Target{{URL: server.URL}}, Schedule: PollSchedule{Buffer: 8}}),
+		WithHandler(LoadAverageMetric, loads),
+	)
+	errs := make(chan error)
+	go func() { errs <- pipeline.Run(context.Background()) }()
+	for loads.handled() < 3 {
+		time.Sleep(time.Millisecond)
+	}
+	pipeline.Stop()
+	if err := <-errs; err != nil {
+		t.Errorf("unexpected error from Run: %v", err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if loads.handled() != served {
+		t.Errorf("unexpected handled count: %v != %v (observed, expected)", loads.handled(), served)
+	}
+}
+
+func TestPipeline_DrainTimeout(t *testing.T) {
+	stuck := &recordingHandler{block: make(chan struct{})}
+	time.AfterFunc(50*time.Millisecond, func() { close(stuck.block) })
+	batches := `[{"type": "load_avg", "payload": {"value": 0.5}}]` + "\n"
+	pipeline := NewPipeline(
+		WithSources(&ReaderSource{Name: "test", Reader: strings.NewReader(batches)}),
+		WithHandler(LoadAverageMetric, stuck),
+		WithDrainTimeout(10*time.Millisecond),
+	)
+	if err := pipeline.Run(context.Background()); !errors.Is(err, ErrDrainTimeout) {
+		t.Errorf("unexpected error from Run: %v != %v (observed, expected)", err, ErrDrainTimeout)
+	}
+	// The stuck handler finished before Run closed the sinks
+	if stuck.handled() != 1 {
+		t.Errorf("unexpected handled count: %v != 1 (observed, expected)", stuck.handled())
+	}
+}
+
+func TestPipeline_Cancel(t *testing.T) {
+	stuck := &recordingHandler{block: make(chan struct{})}
+	time.AfterFunc(50*time.Millisecond, func() { close(stuck.block) })
+	pipeline := NewPipeline(
+		WithSources(&SyntheticSource{Config: SyntheticConfig{CPUCount: 2, Seed: 1}}),
+		WithHandler(LoadAverageMetric, stuck),
+		WithDrainTimeout(0),
+	)
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
+	if err := pipeline.Run(ctx); !errors.Is(err, context.Canceled) {
+		t.Errorf("unexpected error from Run: %v != %v (observed, expected)", err, context.Canceled)
+	}
+}
+
+func TestPipeline_RunPassesContextToSources(t *testing.T) {
+	traceIDs := make(chan string, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case traceIDs <- r.Header.Get(TraceHeader):
+		default:
+		}
+		w.Write([]byte(`[]`))
+	}))
+	defer server.Close()
+
+	pipeline := NewPipeline(WithSources(&HTTPSource{Targets: []Target{{URL: server.URL}}}))
+	ctx, cancel := context.WithCancel(WithTraceID(context.Background(), "abc123"))
+	defer cancel()
+	errs := make(chan error, 1)
+	go func() { errs <- pipeline.Run(ctx) }()
+
+	if observed := <-traceIDs; observed != "abc123" {
+		t.Errorf("unexpected trace header: %v != abc123 (observed, expected)", observed)
+	}
+	pipeline.Stop()
+	if err := <-errs; err != nil {
+		t.Fatalf("unexpected error from Run: %v", err)
+	}
+}
@@ -0,0 +1,173 @@
+package metrics
+
+import (
+	"fmt"
+	"math"
+	"sort"
+)
+
+// Defaults for the quantile sketches kept by handlers. At 1% accuracy, 2048
+// buckets span values over 17 orders of magnitude before any are collapsed
+const (
+	DefaultSketchAccuracy   = 0.01
+	DefaultSketchMaxBuckets = 2048
+)
+
+// zeroThreshold is the smallest value a sketch tells apart from zero
+const zeroThreshold = 1e-9
+
+// Quantiles are estimates of the 50th, 90th and 99th percentiles
+type Quantiles struct {
+	P50 float64
+	P90 float64
+	P99 float64
+}
+
+// QuantileSketch estimates quantiles of a stream of non-negative values in
+// bounded memory, after DDSketch (Masson, Rim & Lee, 2019). Values are counted
+// in logarithmically sized buckets, so any quantile estimate is within a
+// relative error of the sketch's accuracy of the true value: at 1%, a true p99
+// of 80 is reported as somewhere between 79.2 and 80.8. Past maxBuckets the
+// lowest buckets are collapsed together, losing accuracy only for the lowest
+// quantiles. Negative values are counted as zero
+//
+// Sketches with the same accuracy can be merged, e.g. to combine cores or
+// sources, with the same error guarantee as if every value went to one sketch
+type QuantileSketch struct {
+	accuracy   float64
+	maxBuckets int
+	gamma      float64
+	logGamma   float64
+	buckets    map[int]uint64
+	zeros      uint64
+	count      uint64
+	min        float64
+	max        float64
+}
+
+// NewQuantileSketch returns an empty sketch with the given relative accuracy,
+// between 0 and 1, keeping at most maxBuckets buckets
+func NewQuantileSketch(accuracy float64, maxBuckets int) *QuantileSketch {
+	gamma := (1 + accuracy) / (1 - accuracy)
+	return &QuantileSketch{
+		accuracy:   accuracy,
+		maxBuckets: maxBuckets,
+		gamma:      gamma,
+		logGamma:   math.Log(gamma),
+		buckets:    make(map[int]uint64),
+	}
+}
+
+// newDefaultSketch returns an empty sketch with the default accuracy and size
+func newDefaultSketch() *QuantileSketch {
+	return NewQuantileSketch(DefaultSketchAccuracy, DefaultSketchMaxBuckets)
+}
+
+// Add counts a value
+func (s *QuantileSketch) Add(value float64) {
+	if s.count == 0 || value < s.min {
+		s.min = value
+	}
+	if s.count == 0 || s.max < value {
+		s.max = value
+	}
+	s.count++
+	if value < zeroThreshold {
+		s.zeros++
+		return
+	}
+	s.buckets[int(math.Ceil(math.Log(value)/s.logGamma))]++
+	s.collapse()
+}
+
+// Count returns the number of values counted
+func (s *QuantileSketch) Count() uint64 {
+	return s.count
+}
+
+// Quantile estimates the q-quantile, for q between 0 and 1, or returns 0 if
+// the sketch is empty. The 0- and 1-quantiles are the exact min and max
+func (s *QuantileSketch) Quantile(q float64) float64 {
+	switch {
+	case s.count == 0:
+		return 0
+	case q <= 0:
+		return s.min
+	case 1 <= q:
+		return s.max
+	}
+	rank := q * float64(s.count-1)
+	if rank < float64(s.zeros) {
+		return math.Max(s.min, 0)
+	}
+	cumulative := s.zeros
+	for _, i := range s.sortedIndexes() {
+		cumulative += s.buckets[i]
+		if rank < float64(cumulative) {
+			estimate := 2 * math.Pow(s.gamma, float64(i)) / (s.gamma + 1)
+			return math.Min(math.Max(estimate, s.min), s.max)
+		}
+	}
+	return s.max
+}
+
+// Quantiles estimates the 50th, 90th and 99th percentiles
+func (s *QuantileSketch) Quantiles() Quantiles {
+	return Quantiles{P50: s.Quantile(0.5), P90: s.Quantile(0.9), P99: s.Quantile(0.99)}
+}
+
+// Merge adds every value counted by other to the sketch
+func (s *QuantileSketch) Merge(other *QuantileSketch) error {
+	if s.accuracy != other.accuracy {
+		return fmt.Errorf("unable to merge sketches of different accuracy: %v and %v", s.accuracy, other.accuracy)
+	}
+	if other.count == 0 {
+		return nil
+	}
+	if s.count == 0 || other.min < s.min {
+		s.min = other.min
+	}
+	if s.count == 0 || s.max < other.max {
+		s.max = other.max
+	}
+	s.count += other.count
+	s.zeros += other.zeros
+	for i, n := range other.buckets {
+		s.buckets[i] += n
+	}
+	s.collapse()
+	return nil
+}
+
+// Clone returns an independent copy of the sketch
+func (s *QuantileSketch) Clone() *QuantileSketch {
+	clone := *s
+	clone.buckets = make(map[int]uint64, len(s.buckets))
+	for i, n := range s.buckets {
+		clone.buckets[i] = n
+	}
+	return &clone
+}
+
+// collapse merges the lowest buckets into one once there are too many
+func (s *QuantileSketch) collapse() {
+	if len(s.buckets) <= s.maxBuckets {
+		return
+	}
+	indexes := s.sortedIndexes()
+	excess := len(indexes) - s.maxBuckets
+	into := indexes[excess]
+	for _, i := range indexes[:excess] {
+		s.buckets[into] += s.buckets[i]
+		delete(s.buckets, i)
+	}
+}
+
+func (s *QuantileSketch) sortedIndexes() []int {
+	indexes := make([]int, 0, len(s.buckets))
+	for i := range s.buckets {
+		indexes = append(indexes, i)
+	}
+	sort.Ints(indexes)
+	return indexes
+}
@@ -0,0 +1,130 @@
+package metrics
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+// exactQuantile returns the q-quantile of sorted values by nearest rank
+func exactQuantile(sorted []float64, q float64) float64 {
+	return sorted[int(q*float64(len(sorted)-1))]
+}
+
+func TestQuantileSketch_Accuracy(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	distributions := map[string]func() float64{
+		"Uniform":     func() float64 { return rng.Float64() * 100 },
+		"Exponential": func() float64 { return rng.ExpFloat64() },
+		"LogNormal":   func() float64 { return math.Exp(rng.NormFloat64() * 2) },
+	}
+	for name, next := range distributions {
+		t.Run(name, func(t *testing.T) {
+			sketch := newDefaultSketch()
+			values := make([]float64, 10000)
+			for i := range values {
+				values[i] = next()
+				sketch.Add(values[i])
+			}
+			sort.Float64s(values)
+
+			for _, q := range []float64{0, 0.5, 0.9, 0.99, 1} {
+				expected := exactQuantile(values, q)
+				observed := sketch.Quantile(q)
+				if relErr := math.Abs(observed-expected) / expected; DefaultSketchAccuracy < relErr {
+					t.Errorf("unexpected p%v: %v != %v (observed, expected), relative error %v", q*100, observed, expected, relErr)
+				}
+			}
+		})
+	}
+}
+
+func TestQuantileSketch_Merge(t *testing.T) {
+	a, b, all := newDefaultSketch(), newDefaultSketch(), newDefaultSketch()
+	for i := 0; i < 1000; i++ {
+		a.Add(float64(i))
+		b.Add(float64(i) * 10)
+		all.Add(float64(i))
+		all.Add(float64(i) * 10)
+	}
+	if err := a.Merge(b); err != nil {
+		t.Fatalf("unexpected error in Merge(): %v", err)
+	}
+	if a.Count() != all.Count() {
+		t.Errorf("unexpected count: %v != %v (observed, expected)", a.Count(), all.Count())
+	}
+	if a.Quantiles() != all.Quantiles() {
+		t.Errorf("unexpected quantiles: %+v != %+v (observed, expected)", a.Quantiles(), all.Quantiles())
+	}
+
+	// Special bad cases
+	if err := a.Merge(NewQuantileSketch(0.05, DefaultSketchMaxBuckets)); err == nil {
+		t.Error("expected error merging sketches of different accuracy, got none")
+	}
+}
+
+func TestQuantileSketch_Bounded(t *testing.T) {
+	sketch := NewQuantileSketch(DefaultSketchAccuracy, 16)
+	for i := 1; i <= 10000; i++ {
+		sketch.Add(float64(i))
+	}
+	if len(sketch.buckets) != 16 {
+		t.Errorf("unexpected number of buckets: %v != 16 (observed, expected)", len(sketch.buckets))
+	}
+	// Collapsing the lowest buckets leaves the highest quantiles accurate
+	if p99 := sketch.Quantile(0.99); math.Abs(p99-9900)/9900 > DefaultSketchAccuracy {
+		t.Errorf("unexpected p99 after collapsing: %v != 9900 (observed, expected)", p99)
+	}
+}
+
+func TestQuantileSketch_Zeros(t *testing.T) {
+	sketch := newDefaultSketch()
+	if sketch.Quantile(0.5) != 0 {
+		t.Errorf("unexpected quantile of empty sketch: %v != 0 (observed, expected)", sketch.Quantile(0.5))
+	}
+	for i := 0; i < 10; i++ {
+		sketch.Add(0)
+	}
+	sketch.Add(50)
+	for i, expected := range []float64{0, 0, 50} {
+		q := []float64{0.5, 0.9, 1}[i]
+		t.Run(fmt.Sprintf("ValidCase%v", i), func(t *testing.T) {
+			if observed := sketch.Quantile(q); observed != expected {
+				t.Errorf("unexpected p%v: %v != %v (observed, expected)", q*100, observed, expected)
+			}
+		})
+	}
+}
+
+func TestHandlers_Quantiles(t *testing.T) {
+	loadHandler := &LoadMetricsHandler{}
+	cpuHandler := &CPUMetricsHandler{}
+	for i := 1; i <= 100; i++ {
+		loadHandler.Handle(LoadAverage(i))
+		cpuHandler.Handle(CPUUsage{float64(i), 50})
+	}
+
+	loadStats := loadHandler.CurrentStats()
+	if math.Abs(loadStats.Quantiles.P90-90)/90 > DefaultSketchAccuracy {
+		t.Errorf("unexpected load p90: %v != 90 (observed, expected)", loadStats.Quantiles.P90)
+	}
+	cpuStats := cpuHandler.CurrentStats()
+	if len(cpuStats.Quantiles) != 2 {
+		t.Fatalf("unexpected number of cores: %v != 2 (observed, expected)", len(cpuStats.Quantiles))
+	}
+	if math.Abs(cpuStats.Quantiles[0].P99-99)/99 > DefaultSketchAccuracy {
+		t.Errorf("unexpected core 0 p99: %v != 99 (observed, expected)", cpuStats.Quantiles[0].P99)
+	}
+	if cpuStats.Quantiles[1].P50 != 50 {
+		t.Errorf("unexpected core 1 p50: %v != 50 (observed, expected)", cpuStats.Quantiles[1].P50)
+	}
+	// Half the overall values are 50, the rest spread over 1 to 100
+	if math.Abs(cpuStats.OverallQuantiles.P50-50)/50 > DefaultSketchAccuracy {
+		t.Errorf("unexpected overall p50: %v != 50 (observed, expected)", cpuStats.OverallQuantiles.P50)
+	}
+	if sketches := cpuHandler.Sketches(); len(sketches) != 2 || sketches[0].Count() != 100 {
+		t.Errorf("unexpected sketches: %+v", sketches)
+	}
+}
@@ -0,0 +1,245 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// SourceHeader is the request header push clients use to label their metrics.
+// It's only honoured by a Receiver that trusts its clients, like source labels
+// in the batch itself
+const SourceHeader = "X-Demoware-Source"
+
+// DefaultMaxBodyBytes is the largest batch a Receiver accepts by default
+const DefaultMaxBodyBytes = 1 << 20
+
+// Receiver is an http.Handler that accepts POSTed metric batches, in the same
+// JSON shape served by the demoware API, from hosts that can't be polled
+type Receiver struct {
+	// MaxBodyBytes caps the size of a batch, defaulting to DefaultMaxBodyBytes
+	MaxBodyBytes int64
+	// TrustSource lets clients label their own metrics, with SourceHeader or
+	// the source labels metrics carry in the batch, e.g. to take batches from
+	// a relay for several hosts. Otherwise every metric is labelled with the
+	// client's address, so a client can't pose as another
+	TrustSource bool
+
+	mu           sync.RWMutex
+	closed       bool
+	ctx          context.Context
+	resultStream chan Result
+
+	statsMu sync.RWMutex
+	stats   ReceiverStats
+}
+
+// ReceiverStats counts the batches a Receiver has accepted and rejected
+type ReceiverStats struct {
+	AcceptedBatches int
+	AcceptedMetrics int
+	RejectedBatches int
+	// Rejections counts rejected batches by HTTP status code
+	Rejections map[int]int
+}
+
+// NewReceiver returns a Receiver whose accepted batches are buffered in a
+// stream of up to buffer Results, until told to stop
+func NewReceiver(done <-chan interface{}, buffer int) *Receiver {
+	return NewReceiverContext(contextOf(done), buffer)
+}
+
+// NewReceiverContext is like NewReceiver, but stops once ctx is cancelled.
+// Accepted batches carry ctx's values
+func NewReceiverContext(ctx context.Context, buffer int) *Receiver {
+	r := &Receiver{
+		ctx:          ctx,
+		resultStream: make(chan Result, buffer),
+	}
+	go func() {
+		<-ctx.Done()
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		r.closed = true
+		close(r.resultStream)
+	}()
+	return r
+}
+
+// Results returns the stream of accepted batches, ready to be passed to
+// ResultStreamDispatcher.Run
+func (r *Receiver) Results() <-chan Result {
+	return r.resultStream
+}
+
+// ServeHTTP accepts a single batch of metrics
+func (r *Receiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		r.reject(w, http.StatusMethodNotAllowed, fmt.Errorf("method %v not allowed", req.Method))
+		return
+	}
+
+	maxBodyBytes := r.MaxBodyBytes
+	if maxBodyBytes <= 0 {
+		maxBodyBytes = DefaultMaxBodyBytes
+	}
+	data, err := ioutil.ReadAll(http.MaxBytesReader(w, req.Body, maxBodyBytes))
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			r.reject(w, http.StatusRequestEntityTooLarge, err)
+		} else {
+			r.reject(w, http.StatusBadRequest, err)
+		}
+		return
+	}
+	metrics, err := unmarshalMetricsBatch(data)
+	if err != nil {
+		r.reject(w, http.StatusBadRequest, err)
+		return
+	}
+
+	var source string
+	if r.TrustSource {
+		source = req.Header.Get(SourceHeader)
+	}
+	if source == "" {
+		source, _, err = net.SplitHostPort(req.RemoteAddr)
+		if err != nil {
+			source = req.RemoteAddr
+		}
+	}
+	if r.TrustSource {
+		metrics = labelUnlabelledMetrics(metrics, source)
+	} else {
+		metrics = labelMetrics(metrics, source)
+	}
+
+	// The batch outlives the request, so it carries the Receiver's context
+	// rather than req.Context()
+	traceID := req.Header.Get(TraceHeader)
+	if traceID == "" {
+		traceID = NewTraceID()
+	}
+	ctx := WithTraceID(WithSource(r.ctx, source), traceID)
+	w.Header().Set(TraceHeader, traceID)
+
+	if err := r.send(req, Result{Source: source, Metrics: metrics}.WithContext(ctx)); err != nil {
+		r.reject(w, http.StatusServiceUnavailable, err)
+		return
+	}
+	r.statsMu.Lock()
+	r.stats.AcceptedBatches++
+	r.stats.AcceptedMetrics += len(metrics)
+	r.statsMu.Unlock()
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// send passes the batch downstream, giving up if the client goes away or the
+// Receiver is stopped while waiting
+func (r *Receiver) send(req *http.Request, result Result) error {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if r.closed {
+		return fmt.Errorf("receiver is shutting down")
+	}
+	select {
+	case r.resultStream <- result:
+		return nil
+	case <-r.ctx.Done():
+		return fmt.Errorf("receiver is shutting down")
+	case <-req.Context().Done():
+		return req.Context().Err()
+	}
+}
+
+// reject counts and logs a rejected batch and responds with the given status
+func (r *Receiver) reject(w http.ResponseWriter, status int, err error) {
+	r.statsMu.Lock()
+	r.stats.RejectedBatches++
+	if r.stats.Rejections == nil {
+		r.stats.Rejections = make(map[int]int)
+	}
+	r.stats.Rejections[status]++
+	r.statsMu.Unlock()
+
+	log.WithField("status", status).Warn(err)
+	http.Error(w, err.Error(), status)
+}
+
+// CurrentStats returns the current ReceiverStats in a concurrent-safe manner
+func (r *Receiver) CurrentStats() ReceiverStats {
+	r.statsMu.RLock()
+	defer r.statsMu.RUnlock()
+
+	rejections := make(map[int]int, len(r.stats.Rejections))
+	for status, n := range r.stats.Rejections {
+		rejections[status] = n
+	}
+	stats := r.stats
+	stats.Rejections = rejections
+	return stats
+}
+
+// PushSource is a Source that serves a Receiver on Addr at /metrics
+type PushSource struct {
+	lifecycle
+	Addr         string
+	MaxBodyBytes int64
+	// TrustSource is passed to the Receiver
+	TrustSource bool
+	// Buffer is the number of accepted batches that may queue up before
+	// clients are made to wait
+	Buffer int
+
+	mu       sync.RWMutex
+	receiver *Receiver
+}
+
+// Start begins listening for pushed batches
+func (s *PushSource) Start(ctx context.Context) (<-chan Result, error) {
+	listener, err := net.Listen("tcp", s.Addr)
+	if err != nil {
+		return nil, err
+	}
+	ctx = s.start(ctx)
+	receiver := NewReceiverContext(ctx, s.Buffer)
+	receiver.MaxBodyBytes = s.MaxBodyBytes
+	receiver.TrustSource = s.TrustSource
+	s.mu.Lock()
+	s.receiver = receiver
+	s.mu.Unlock()
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", receiver)
+	server := &http.Server{Handler: mux}
+	go func() {
+		if err := server.Serve(listener); err != http.ErrServerClosed {
+			log.WithField("addr", s.Addr).Error(err)
+		}
+	}()
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+	return receiver.Results(), nil
+}
+
+// CurrentStats returns the ReceiverStats of the running Receiver, if started
+func (s *PushSource) CurrentStats() ReceiverStats {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.receiver == nil {
+		return ReceiverStats{}
+	}
+	return s.receiver.CurrentStats()
+}
@@ -0,0 +1,96 @@
+package metrics
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestReceiver_ServeHTTP(t *testing.T) {
+	done := make(chan interface{})
+	defer close(done)
+	receiver := NewReceiver(done, 1)
+	receiver.MaxBodyBytes = 128
+
+	testCases := []struct {
+		Name           string
+		Method         string
+		Body           string
+		ExpectedStatus int
+	}{
+		{"Accepted", http.MethodPost, `[{"type": "load_avg", "payload": {"value": 0.5}}]`, http.StatusAccepted},
+		{"WrongMethod", http.MethodGet, "", http.StatusMethodNotAllowed},
+		{"Malformed", http.MethodPost, `[{"type": `, http.StatusBadRequest},
+		{"TooLarge", http.MethodPost, "[" + strings.Repeat(" ", 256) + "]", http.StatusRequestEntityTooLarge},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.Name, func(t *testing.T) {
+			req := httptest.NewRequest(testCase.Method, "/metrics", strings.NewReader(testCase.Body))
+			w := httptest.NewRecorder()
+			receiver.ServeHTTP(w, req)
+			if w.Code != testCase.ExpectedStatus {
+				t.Errorf("unexpected status: %v != %v (observed, expected)", w.Code, testCase.ExpectedStatus)
+			}
+		})
+	}
+
+	// httptest requests come from 192.0.2.1
+	result := <-receiver.Results()
+	if result.Source != "192.0.2.1" || len(result.Metrics) != 1 || result.Metrics[0].Source != "192.0.2.1" {
+		t.Errorf("unexpected result: %+v", result)
+	}
+	stats := receiver.CurrentStats()
+	if stats.AcceptedBatches != 1 || stats.AcceptedMetrics != 1 || stats.RejectedBatches != 3 {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+	if stats.Rejections[http.StatusBadRequest] != 1 {
+		t.Errorf("unexpected rejections: %v", stats.Rejections)
+	}
+}
+
+func TestReceiver_ShuttingDown(t *testing.T) {
+	done := make(chan interface{})
+	receiver := NewReceiver(done, 0)
+	close(done)
+	for range receiver.Results() {
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/metrics", strings.NewReader(`[]`))
+	w := httptest.NewRecorder()
+	receiver.ServeHTTP(w, req)
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("unexpected status: %v != %v (observed, expected)", w.Code, http.StatusServiceUnavailable)
+	}
+}
+
+func TestReceiver_TrustSource(t *testing.T) {
+	body := `[{"type": "load_avg", "payload": {"value": 0.5}, "source": "other-host"}, {"type": "load_avg", "payload": {"value": 1.5}}]`
+	testCases := []struct {
+		TrustSource     bool
+		ExpectedSources []string
+	}{
+		// An untrusted client is labelled by its address, whatever it claims
+		{TrustSource: false, ExpectedSources: []string{"192.0.2.1", "192.0.2.1"}},
+		{TrustSource: true, ExpectedSources: []string{"other-host", "nat-host"}},
+	}
+	for i, testCase := range testCases {
+		t.Run(fmt.Sprintf("ValidCase%v", i), func(t *testing.T) {
+			done := make(chan interface{})
+			defer close(done)
+			receiver := NewReceiver(done, 1)
+			receiver.TrustSource = testCase.TrustSource
+
+			req := httptest.NewRequest(http.MethodPost, "/metrics", strings.NewReader(body))
+			req.Header.Set(SourceHeader, "nat-host")
+			receiver.ServeHTTP(httptest.NewRecorder(), req)
+			result := <-receiver.Results()
+			for j, metric := range result.Metrics {
+				if metric.Source != testCase.ExpectedSources[j] {
+					t.Errorf("unexpected source of metric %v: %v != %v (observed, expected)", j, metric.Source, testCase.ExpectedSources[j])
+				}
+			}
+		})
+	}
+}
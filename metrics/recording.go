@@ -0,0 +1,162 @@
+package metrics
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// Recording is a single raw batch as received from a source, one per line of
+// a recording file
+type Recording struct {
+	Received time.Time `json:"received"`
+	Source   string    `json:"source,omitempty"`
+	// Batch holds the raw batch if it was valid JSON, otherwise Raw holds it
+	// verbatim so that malformed payloads can be replayed too
+	Batch json.RawMessage `json:"batch,omitempty"`
+	Raw   string          `json:"raw,omitempty"`
+}
+
+// data returns the raw batch bytes
+func (r Recording) data() []byte {
+	if r.Batch != nil {
+		return r.Batch
+	}
+	return []byte(r.Raw)
+}
+
+// Recorder appends raw batches to a JSONL recording file
+type Recorder struct {
+	mu      sync.Mutex
+	file    *os.File
+	encoder *json.Encoder
+}
+
+// NewRecorder opens the recording file at path for appending, creating it if
+// needed
+func NewRecorder(path string) (*Recorder, error) {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &Recorder{file: f, encoder: json.NewEncoder(f)}, nil
+}
+
+// Record writes a raw batch received from source at the given time
+func (r *Recorder) Record(source string, received time.Time, data []byte) error {
+	recording := Recording{Received: received, Source: source}
+	if json.Valid(data) {
+		recording.Batch = append(json.RawMessage{}, data...)
+	} else {
+		recording.Raw = string(data)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err := r.encoder.Encode(recording); err != nil {
+		return fmt.Errorf("unable to record batch: %v", err)
+	}
+	return nil
+}
+
+// Close flushes and closes the recording file
+func (r *Recorder) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err := r.file.Sync(); err != nil {
+		r.file.Close()
+		return err
+	}
+	return r.file.Close()
+}
+
+// ReplaySource replays a recording file made by a Recorder, decoding each
+// batch as if it had just been scraped
+type ReplaySource struct {
+	lifecycle
+	Path string
+	// Speed scales the pace of the replay relative to the original: 1 replays
+	// at the original speed, 2 twice as fast, and 0 as fast as possible
+	Speed float64
+}
+
+// Start opens the recording and begins replaying it, closing the stream once
+// every batch has been replayed
+func (s *ReplaySource) Start(ctx context.Context) (<-chan Result, error) {
+	f, err := os.Open(s.Path)
+	if err != nil {
+		return nil, err
+	}
+	return replay(ctx, s.start(ctx), f, s.Speed), nil
+}
+
+// replay emits a Result for each Recording read from r, carrying ctx, until
+// stop is cancelled, spacing them out by their original receive times divided
+// by speed
+func replay(ctx, stop context.Context, r io.ReadCloser, speed float64) <-chan Result {
+	resultStream := make(chan Result)
+	go func() {
+		defer close(resultStream)
+		defer r.Close()
+
+		var first time.Time
+		started := time.Now()
+		scanner := bufio.NewScanner(r)
+		scanner.Buffer(make([]byte, 64*1024), 2*DefaultMaxBodyBytes)
+		for stop.Err() == nil && scanner.Scan() {
+			if len(scanner.Bytes()) == 0 {
+				continue
+			}
+			var recording Recording
+			result := Result{}.WithContext(ctx)
+			if err := json.Unmarshal(scanner.Bytes(), &recording); err != nil {
+				result.Error = fmt.Errorf("unable to parse recording: %v", err)
+			} else {
+				if first.IsZero() {
+					first = recording.Received
+				}
+				if 0 < speed {
+					offset := time.Duration(float64(recording.Received.Sub(first)) / speed)
+					if wait := time.Until(started.Add(offset)); 0 < wait {
+						timer := time.NewTimer(wait)
+						select {
+						case <-ctx.Done():
+							timer.Stop()
+							return
+						case <-stop.Done():
+							timer.Stop()
+							return
+						case <-timer.C:
+						}
+					}
+				}
+				result.Source = recording.Source
+				result = result.WithContext(WithSource(ctx, recording.Source))
+				if metrics, err := unmarshalMetricsBatch(recording.data()); err != nil {
+					result.Error = &IngestError{Err: err, Retryable: false, Raw: recording.data()}
+				} else {
+					result.Metrics = labelMetrics(metrics, recording.Source)
+				}
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case resultStream <- result:
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			select {
+			case <-ctx.Done():
+			case resultStream <- Result{Error: err}.WithContext(ctx):
+			}
+		}
+	}()
+	return resultStream
+}
@@ -0,0 +1,95 @@
+package metrics
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRecordAndReplay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "recording.jsonl")
+	recorder, err := NewRecorder(path)
+	if err != nil {
+		t.Fatalf("unexpected error in NewRecorder(): %v", err)
+	}
+	received := time.Date(2020, 4, 2, 11, 38, 0, 0, time.UTC)
+	batches := []string{
+		`[{"type": "load_avg", "payload": {"value": 0.5}}]`,
+		`[{"type": `,
+		`[{"type": "load_avg", "payload": {"value": 1.5}}]`,
+	}
+	for i, batch := range batches {
+		err := recorder.Record("web-1", received.Add(time.Duration(i)*20*time.Millisecond), []byte(batch))
+		if err != nil {
+			t.Fatalf("unexpected error in recorder.Record(): %v", err)
+		}
+	}
+	if err := recorder.Close(); err != nil {
+		t.Fatalf("unexpected error in recorder.Close(): %v", err)
+	}
+
+	testCases := []struct {
+		Speed       float64
+		MinDuration time.Duration
+	}{
+		{0, 0},
+		{1, 40 * time.Millisecond},
+		{2, 20 * time.Millisecond},
+	}
+	for _, testCase := range testCases {
+		t.Run(fmt.Sprintf("Speed%v", testCase.Speed), func(t *testing.T) {
+			source := &ReplaySource{Path: path, Speed: testCase.Speed}
+			start := time.Now()
+			resultStream, err := source.Start(context.Background())
+			if err != nil {
+				t.Fatalf("unexpected error in source.Start(): %v", err)
+			}
+			results := make([]Result, 0)
+			for result := range resultStream {
+				results = append(results, result)
+			}
+			if elapsed := time.Since(start); elapsed < testCase.MinDuration {
+				t.Errorf("replay finished too quickly: %v < %v", elapsed, testCase.MinDuration)
+			}
+
+			if len(results) != len(batches) {
+				t.Fatalf("unexpected number of results: %v != %v (observed, expected)", len(results), len(batches))
+			}
+			if results[0].Error != nil || results[0].Metrics[0].Payload.Value != LoadAverage(0.5) || results[0].Metrics[0].Source != "web-1" {
+				t.Errorf("unexpected first result: %+v", results[0])
+			}
+			if results[1].Error == nil {
+				t.Error("expected malformed batch to be replayed as an error")
+			}
+		})
+	}
+}
+
+func TestTarget_FetchRecordsRawBatch(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `[{"type": "load_avg", "payload": {"value": 0.5}}]`)
+	}))
+	defer server.Close()
+
+	path := filepath.Join(t.TempDir(), "recording.jsonl")
+	recorder, err := NewRecorder(path)
+	if err != nil {
+		t.Fatalf("unexpected error in NewRecorder(): %v", err)
+	}
+	Target{Name: "web-1", URL: server.URL, Recorder: recorder}.fetch(context.Background(), 0)
+	recorder.Close()
+
+	source := &ReplaySource{Path: path}
+	resultStream, err := source.Start(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error in source.Start(): %v", err)
+	}
+	result := <-resultStream
+	if result.Error != nil || result.Source != "web-1" || len(result.Metrics) != 1 {
+		t.Errorf("unexpected replayed result: %+v", result)
+	}
+}
@@ -0,0 +1,135 @@
+package metrics
+
+import (
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// PollSchedule controls how often a generator calls the metrics API. The zero
+// value polls as fast as downstream consumers drain the stream
+type PollSchedule struct {
+	// Interval is the time between polls, if non-zero
+	Interval time.Duration
+	// Align schedules polls on wall-clock multiples of Interval (e.g. :00,
+	// :15, :30, :45 for a 15s interval) rather than relative to startup
+	Align bool
+	// MaxRPS caps the request rate, including retries, if non-zero
+	MaxRPS float64
+	// Burst is the number of requests allowed at once under MaxRPS (default 1)
+	Burst int
+	// Buffer is the number of Results that may queue up between the generator
+	// and its consumer before the generator blocks
+	Buffer int
+	// Backpressure adapts the poll rate to downstream saturation, if set. The
+	// generator's own output buffer is always included in the saturation
+	Backpressure *Backpressure
+	// Timeout bounds each request, on top of any deadline on the generator's
+	// context, if non-zero. Timed out requests are retried like connection
+	// errors
+	Timeout time.Duration
+	// OnMissed is called with the number of ticks skipped whenever the
+	// generator falls behind its schedule. Defaults to logging a warning
+	OnMissed func(missed int)
+}
+
+// pollClock turns a PollSchedule into delays between calls
+type pollClock struct {
+	schedule PollSchedule
+	limiter  *RateLimiter
+	next     time.Time
+	now      func() time.Time
+}
+
+func newPollClock(schedule PollSchedule) *pollClock {
+	clock := &pollClock{schedule: schedule, now: time.Now}
+	if 0 < schedule.MaxRPS {
+		clock.limiter = NewRateLimiter(schedule.MaxRPS, schedule.Burst)
+	}
+	if clock.schedule.OnMissed == nil {
+		clock.schedule.OnMissed = func(missed int) {
+			log.WithFields(log.Fields{
+				"missed":   missed,
+				"interval": schedule.Interval,
+			}).Warn("Generator fell behind its poll schedule, skipping ticks")
+		}
+	}
+	return clock
+}
+
+// delayAfter returns how long to wait before the next call, given that the
+// call can't happen for at least minDelay (e.g. due to backoff). Ticks that
+// pass while waiting or while downstream is busy are skipped and reported
+func (c *pollClock) delayAfter(minDelay time.Duration) time.Duration {
+	now := c.now()
+	at := now.Add(minDelay)
+
+	if interval := c.schedule.Interval; 0 < interval {
+		if c.next.IsZero() {
+			c.next = at
+			if c.schedule.Align {
+				c.next = at.Truncate(interval)
+				if c.next.Before(at) {
+					c.next = c.next.Add(interval)
+				}
+			}
+		} else if missed := int(at.Sub(c.next) / interval); 0 < missed {
+			c.schedule.OnMissed(missed)
+			c.next = c.next.Add(time.Duration(missed) * interval)
+		}
+		if at.Before(c.next) {
+			at = c.next
+		}
+		c.next = c.next.Add(interval)
+	}
+
+	if c.limiter != nil {
+		at = at.Add(c.limiter.Reserve(at))
+	}
+	return at.Sub(now)
+}
+
+// RateLimiter is a token bucket limiting calls to a rate per second, with
+// bursts of up to burst calls
+type RateLimiter struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// NewRateLimiter returns a full RateLimiter
+func NewRateLimiter(rate float64, burst int) *RateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &RateLimiter{rate: rate, burst: float64(burst), tokens: float64(burst)}
+}
+
+// Reserve takes a token for a call at the given time and returns how much
+// longer after that time the caller must wait before making the call
+func (l *RateLimiter) Reserve(at time.Time) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.last.IsZero() {
+		l.last = at
+	} else if l.last.Before(at) {
+		l.tokens += at.Sub(l.last).Seconds() * l.rate
+		if l.burst < l.tokens {
+			l.tokens = l.burst
+		}
+		l.last = at
+	}
+
+	// Tokens are accounted as of l.last, which may be ahead of at when the
+	// limiter is shared, so the wait is measured from there
+	wait := l.last.Sub(at)
+	l.tokens--
+	if l.tokens < 0 {
+		wait += time.Duration(-l.tokens / l.rate * float64(time.Second))
+	}
+	return wait
+}
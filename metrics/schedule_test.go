@@ -0,0 +1,68 @@
+package metrics
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPollClock_DelayAfter(t *testing.T) {
+	now := time.Date(2020, 4, 2, 11, 38, 7, 0, time.UTC)
+	missed := 0
+	clock := newPollClock(PollSchedule{
+		Interval: 10 * time.Second,
+		Align:    true,
+		OnMissed: func(n int) { missed += n },
+	})
+	clock.now = func() time.Time { return now }
+
+	if d := clock.delayAfter(0); d != 3*time.Second {
+		t.Errorf("unexpected aligned first delay: %v != %v (observed, expected)", d, 3*time.Second)
+	}
+	now = now.Add(3 * time.Second)
+	if d := clock.delayAfter(0); d != 10*time.Second {
+		t.Errorf("unexpected steady-state delay: %v != %v (observed, expected)", d, 10*time.Second)
+	}
+
+	// Downstream stalls until :45, so the :30 tick is skipped and :40 fires late
+	now = now.Add(35 * time.Second)
+	if d := clock.delayAfter(0); d != 0 {
+		t.Errorf("unexpected delay when behind schedule: %v != 0 (observed, expected)", d)
+	}
+	if missed != 1 {
+		t.Errorf("unexpected missed ticks: %v != 1 (observed, expected)", missed)
+	}
+	if d := clock.delayAfter(0); d != 5*time.Second {
+		t.Errorf("unexpected delay after catching up: %v != %v (observed, expected)", d, 5*time.Second)
+	}
+}
+
+func TestPollClock_MinDelay(t *testing.T) {
+	now := time.Now()
+	clock := newPollClock(PollSchedule{Interval: time.Second, OnMissed: func(int) {}})
+	clock.now = func() time.Time { return now }
+
+	clock.delayAfter(0)
+	if d := clock.delayAfter(5 * time.Second); d != 5*time.Second {
+		t.Errorf("backoff should override the schedule: %v != %v (observed, expected)", d, 5*time.Second)
+	}
+}
+
+func TestRateLimiter_Reserve(t *testing.T) {
+	now := time.Now()
+	limiter := NewRateLimiter(2, 2)
+
+	for i := 0; i < 2; i++ {
+		if wait := limiter.Reserve(now); wait != 0 {
+			t.Fatalf("unexpected wait within burst: %v", wait)
+		}
+	}
+	if wait := limiter.Reserve(now); wait != 500*time.Millisecond {
+		t.Errorf("unexpected wait past burst: %v != %v (observed, expected)", wait, 500*time.Millisecond)
+	}
+	if wait := limiter.Reserve(now.Add(time.Second)); wait != 0 {
+		t.Errorf("unexpected wait after refill: %v != 0 (observed, expected)", wait)
+	}
+	if wait := limiter.Reserve(now.Add(time.Second)); wait != 500*time.Millisecond {
+		t.Errorf("burst should not refill past one token here: %v != %v (observed, expected)", wait, 500*time.Millisecond)
+	}
+}
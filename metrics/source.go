@@ -0,0 +1,200 @@
+package metrics
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/sambarnes/demoware-consumer/stage"
+)
+
+// Source produces batches of metrics as a stream of Results. Once stopped, a
+// Source produces no more and closes the stream after sending the Results it
+// already has. The stream is closed straight away if ctx is cancelled, and
+// once the Source runs out of input. The Results carry ctx's values, such as a
+// trace ID
+type Source interface {
+	Start(ctx context.Context) (<-chan Result, error)
+	Stop()
+}
+
+// StartSources starts each source and fans their Results in to a single
+// stream. If any source fails to start, those already started are stopped
+func StartSources(done <-chan interface{}, sources ...Source) (<-chan Result, error) {
+	return StartSourcesContext(contextOf(done), sources...)
+}
+
+// StartSourcesContext is like StartSources, but stops every source once ctx
+// is cancelled
+func StartSourcesContext(ctx context.Context, sources ...Source) (<-chan Result, error) {
+	resultStreams := make([]<-chan Result, 0, len(sources))
+	for _, source := range sources {
+		resultStream, err := source.Start(ctx)
+		if err != nil {
+			for _, started := range sources[:len(resultStreams)] {
+				started.Stop()
+			}
+			return nil, err
+		}
+		resultStreams = append(resultStreams, resultStream)
+	}
+	return stage.FanIn(ctx, resultStreams...), nil
+}
+
+// lifecycle implements Stop for Sources, deriving the context they poll for
+// input under from the caller's, cancelled once Stop is called. Results
+// already produced are sent under the caller's context, so they drain
+type lifecycle struct {
+	mu      sync.Mutex
+	stopped bool
+	cancels []context.CancelFunc
+}
+
+// start returns a copy of ctx that's cancelled once ctx is or Stop is called,
+// for the Source to stop producing Results under
+func (l *lifecycle) start(ctx context.Context) context.Context {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	ctx, cancel := context.WithCancel(ctx)
+	if l.stopped {
+		cancel()
+	} else {
+		l.cancels = append(l.cancels, cancel)
+	}
+	return ctx
+}
+
+// Stop signals the Source to stop producing Results
+func (l *lifecycle) Stop() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.stopped = true
+	for _, cancel := range l.cancels {
+		cancel()
+	}
+	l.cancels = nil
+}
+
+// HTTPSource polls a fixed set of demoware APIs
+type HTTPSource struct {
+	lifecycle
+	Targets  []Target
+	Schedule PollSchedule
+	// Recorder, if set, captures every raw batch scraped from any target
+	Recorder *Recorder
+}
+
+// Start begins polling every target
+func (s *HTTPSource) Start(ctx context.Context) (<-chan Result, error) {
+	if len(s.Targets) == 0 {
+		return nil, fmt.Errorf("http source has no targets")
+	}
+	targets := make([]Target, len(s.Targets))
+	for i, target := range s.Targets {
+		if target.Recorder == nil {
+			target.Recorder = s.Recorder
+		}
+		targets[i] = target
+	}
+	return runTargetsGenerator(ctx, s.start(ctx), targets, s.Schedule), nil
+}
+
+// ReaderSource reads metric batches from a stream, one JSON batch per line in
+// the same shape served by the demoware API. Malformed lines produce a Result
+// with a non-retryable IngestError rather than stopping the stream
+type ReaderSource struct {
+	lifecycle
+	// Name labels each metric read from the stream
+	Name   string
+	Reader io.Reader
+}
+
+// NewStdinSource returns a ReaderSource reading batches from standard input.
+// A blocked read isn't interrupted by Stop, so its goroutine lingers until the
+// next line or EOF
+func NewStdinSource() *ReaderSource {
+	return &ReaderSource{Name: "stdin", Reader: os.Stdin}
+}
+
+// Start begins reading batches, closing the stream at EOF
+func (s *ReaderSource) Start(ctx context.Context) (<-chan Result, error) {
+	return readBatches(ctx, s.start(ctx), s.Name, s.Reader, nil), nil
+}
+
+// readBatches emits a Result for each line read from r, carrying ctx, until
+// stop is cancelled, and closes closer (if any) once finished
+func readBatches(ctx, stop context.Context, name string, r io.Reader, closer io.Closer) <-chan Result {
+	resultStream := make(chan Result)
+	go func() {
+		defer close(resultStream)
+		if closer != nil {
+			defer closer.Close()
+		}
+
+		scanner := bufio.NewScanner(r)
+		scanner.Buffer(make([]byte, 64*1024), DefaultMaxBodyBytes)
+		for stop.Err() == nil && scanner.Scan() {
+			if len(scanner.Bytes()) == 0 {
+				continue
+			}
+			result := Result{Source: name}.WithContext(WithSource(ctx, name))
+			if metrics, err := unmarshalMetricsBatch(scanner.Bytes()); err != nil {
+				result.Error = &IngestError{Err: err, Retryable: false, Raw: append([]byte{}, scanner.Bytes()...)}
+			} else {
+				result.Metrics = labelMetrics(metrics, name)
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case resultStream <- result:
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			select {
+			case <-ctx.Done():
+			case resultStream <- Result{Source: name, Error: err}.WithContext(WithSource(ctx, name)):
+			}
+		}
+	}()
+	return resultStream
+}
+
+// FileSource replays metric batches from a file, one JSON batch per line
+type FileSource struct {
+	lifecycle
+	Path string
+}
+
+// Start opens the file and begins reading batches, closing the stream at EOF
+func (s *FileSource) Start(ctx context.Context) (<-chan Result, error) {
+	f, err := os.Open(s.Path)
+	if err != nil {
+		return nil, err
+	}
+	return readBatches(ctx, s.start(ctx), s.Path, f, f), nil
+}
+
+// labelMetrics sets the source label on each metric, overriding any label in
+// the payload so that one source can't file its metrics under another
+func labelMetrics(metrics []Metric, source string) []Metric {
+	for i := range metrics {
+		metrics[i].Source = source
+	}
+	return metrics
+}
+
+// labelUnlabelledMetrics sets the source label on each metric that doesn't
+// have one, for batches whose own labels can be trusted
+func labelUnlabelledMetrics(metrics []Metric, source string) []Metric {
+	for i := range metrics {
+		if metrics[i].Source == "" {
+			metrics[i].Source = source
+		}
+	}
+	return metrics
+}
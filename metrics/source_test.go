@@ -0,0 +1,83 @@
+package metrics
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReaderSource(t *testing.T) {
+	input := strings.Join([]string{
+		`[{"type": "load_avg", "payload": {"value": 0.5}}]`,
+		``,
+		`[{"type": `,
+		`[{"type": "load_avg", "payload": {"value": 1.5}, "source": "elsewhere"}]`,
+	}, "\n")
+	source := &ReaderSource{Name: "test", Reader: strings.NewReader(input)}
+	resultStream, err := source.Start(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error in source.Start(): %v", err)
+	}
+
+	results := make([]Result, 0)
+	for result := range resultStream {
+		results = append(results, result)
+	}
+	if len(results) != 3 {
+		t.Fatalf("unexpected number of results: %v != 3 (observed, expected)", len(results))
+	}
+	if results[0].Error != nil || results[0].Metrics[0].Source != "test" {
+		t.Errorf("unexpected first result: %+v", results[0])
+	}
+	if results[1].Error == nil || IsRetryable(results[1].Error) {
+		t.Errorf("expected non-retryable error for malformed line, got %v", results[1].Error)
+	}
+	if results[2].Metrics[0].Source != "test" {
+		t.Errorf("metric's own source label should be overridden, got %v", results[2].Metrics[0].Source)
+	}
+}
+
+func TestStartSources(t *testing.T) {
+	synthetic := &SyntheticSource{Interval: time.Millisecond, Config: SyntheticConfig{CPUCount: 2, Seed: 1}}
+	reader := &ReaderSource{Name: "reader", Reader: strings.NewReader(`[]`)}
+	done := make(chan interface{})
+	defer close(done)
+	resultStream, err := StartSources(done, synthetic, reader)
+	if err != nil {
+		t.Fatalf("unexpected error in StartSources(): %v", err)
+	}
+
+	seen := map[string]bool{}
+	for len(seen) < 2 {
+		result := <-resultStream
+		if result.Error != nil {
+			t.Fatalf("unexpected error in result: %v", result.Error)
+		}
+		seen[result.Source] = true
+	}
+
+	synthetic.Stop()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case _, ok := <-resultStream:
+			if ok == false {
+				return
+			}
+		case <-timeout:
+			t.Fatal("merged stream still open after every source stopped")
+		}
+	}
+}
+
+func TestStartSources_StopsStartedOnError(t *testing.T) {
+	synthetic := &SyntheticSource{Interval: time.Millisecond, Config: SyntheticConfig{CPUCount: 1}}
+	broken := &SyntheticSource{}
+	if _, err := StartSources(make(chan interface{}), synthetic, broken); err == nil {
+		t.Fatal("expected error in StartSources(), got none")
+	}
+	if synthetic.stopped == false {
+		t.Error("started source was not stopped")
+	}
+}
@@ -0,0 +1,217 @@
+package metrics
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/sambarnes/demoware-consumer/stage"
+)
+
+// errSyntheticFailure is the error injected by synthetic generators
+var errSyntheticFailure = errors.New("synthetic failure")
+
+// Distribution produces random values for synthetic metrics
+type Distribution interface {
+	Sample(rng *rand.Rand) float64
+}
+
+// Constant always produces the same value
+type Constant float64
+
+// Sample returns c
+func (c Constant) Sample(rng *rand.Rand) float64 {
+	return float64(c)
+}
+
+// Uniform produces values evenly spread over [Min, Max)
+type Uniform struct {
+	Min float64
+	Max float64
+}
+
+// Sample returns a uniformly distributed value
+func (u Uniform) Sample(rng *rand.Rand) float64 {
+	return u.Min + rng.Float64()*(u.Max-u.Min)
+}
+
+// Normal produces normally distributed values, clamped to [Min, Max] unless
+// both are zero
+type Normal struct {
+	Mean   float64
+	StdDev float64
+	Min    float64
+	Max    float64
+}
+
+// Sample returns a normally distributed value
+func (n Normal) Sample(rng *rand.Rand) float64 {
+	v := n.Mean + rng.NormFloat64()*n.StdDev
+	if n.Min != 0 || n.Max != 0 {
+		v = math.Max(n.Min, math.Min(n.Max, v))
+	}
+	return v
+}
+
+// SyntheticConfig describes the metrics a synthetic generator produces
+type SyntheticConfig struct {
+	CPUCount int
+	// Load defaults to Uniform over [0, CPUCount)
+	Load Distribution
+	// CPUUsage is sampled once per core and defaults to Uniform over [0, 100)
+	CPUUsage Distribution
+	// KernelAge is how long ago, in seconds, the last kernel upgrade was.
+	// Defaults to Constant(0)
+	KernelAge Distribution
+	// BatchSize is the number of metrics per batch, cycling through load,
+	// CPU and kernel metrics (default 3, one of each)
+	BatchSize int
+	// ErrorRate is the fraction of batches that fail outright
+	ErrorRate float64
+	// MalformedRate is the fraction of batches whose payload is invalid JSON
+	MalformedRate float64
+	// Seed makes the generated metrics reproducible, if non-zero
+	Seed int64
+}
+
+// syntheticGenerator produces raw batches according to a SyntheticConfig
+type syntheticGenerator struct {
+	mu     sync.Mutex
+	config SyntheticConfig
+	rng    *rand.Rand
+}
+
+func newSyntheticGenerator(config SyntheticConfig) (*syntheticGenerator, error) {
+	if config.CPUCount <= 0 {
+		return nil, fmt.Errorf("synthetic generator needs a positive CPU count, got %v", config.CPUCount)
+	}
+	if config.Load == nil {
+		config.Load = Uniform{Max: float64(config.CPUCount)}
+	}
+	if config.CPUUsage == nil {
+		config.CPUUsage = Uniform{Max: 100}
+	}
+	if config.KernelAge == nil {
+		config.KernelAge = Constant(0)
+	}
+	if config.BatchSize <= 0 {
+		config.BatchSize = 3
+	}
+	seed := config.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	return &syntheticGenerator{config: config, rng: rand.New(rand.NewSource(seed))}, nil
+}
+
+// batch returns the raw JSON of the next batch, or errSyntheticFailure if
+// this batch should fail outright
+func (g *syntheticGenerator) batch() ([]byte, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.rng.Float64() < g.config.ErrorRate {
+		return nil, errSyntheticFailure
+	}
+	metrics := make([]Metric, g.config.BatchSize)
+	for i := range metrics {
+		switch i % 3 {
+		case 0:
+			metrics[i] = Metric{Type: LoadAverageMetric, Payload: MetricPayload{Value: LoadAverage(g.config.Load.Sample(g.rng))}}
+		case 1:
+			usages := make(CPUUsage, g.config.CPUCount)
+			for j := range usages {
+				usages[j] = g.config.CPUUsage.Sample(g.rng)
+			}
+			metrics[i] = Metric{Type: CPUUsageMetric, Payload: MetricPayload{Value: usages}}
+		case 2:
+			age := time.Duration(g.config.KernelAge.Sample(g.rng) * float64(time.Second))
+			upgraded := KernelUpgrade{time.Now().Add(-age)}
+			metrics[i] = Metric{Type: LastKernelUpgradeMetric, Payload: MetricPayload{Value: upgraded}}
+		}
+	}
+	data, err := json.Marshal(metrics)
+	if err != nil {
+		return nil, err
+	}
+	if g.rng.Float64() < g.config.MalformedRate {
+		data = data[:g.rng.Intn(len(data))]
+	}
+	return data, nil
+}
+
+// SyntheticSource generates metric batches without a demoware API, for demos
+// and load tests. Batches are decoded just like scraped ones, so malformed
+// payloads surface as the same errors
+type SyntheticSource struct {
+	lifecycle
+	// Name labels each generated metric, defaulting to "synthetic"
+	Name string
+	// Interval is the time between batches, or 0 to generate them as fast as
+	// they're consumed
+	Interval time.Duration
+	Config   SyntheticConfig
+}
+
+// Start begins generating batches
+func (s *SyntheticSource) Start(ctx context.Context) (<-chan Result, error) {
+	generator, err := newSyntheticGenerator(s.Config)
+	if err != nil {
+		return nil, err
+	}
+	name := s.Name
+	if name == "" {
+		name = "synthetic"
+	}
+	stop := s.start(ctx)
+	batch := func() Result {
+		result := Result{Source: name}.WithContext(WithSource(ctx, name))
+		data, err := generator.batch()
+		if err != nil {
+			result.Error = &IngestError{Err: err, Retryable: true}
+			return result
+		}
+		metrics, err := unmarshalMetricsBatch(data)
+		if err != nil {
+			result.Error = &IngestError{Err: err, Retryable: false, Raw: data}
+			return result
+		}
+		result.Metrics = labelMetrics(metrics, name)
+		return result
+	}
+	delay := func() time.Duration { return s.Interval }
+	return stage.RepeatWithDelayUntil(ctx, stop, batch, delay), nil
+}
+
+// SyntheticServer is an http.Handler mimicking the demoware API's /metrics
+// endpoint, for load testing a consumer without the real service
+type SyntheticServer struct {
+	generator *syntheticGenerator
+}
+
+// NewSyntheticServer returns a SyntheticServer generating batches according
+// to config
+func NewSyntheticServer(config SyntheticConfig) (*SyntheticServer, error) {
+	generator, err := newSyntheticGenerator(config)
+	if err != nil {
+		return nil, err
+	}
+	return &SyntheticServer{generator: generator}, nil
+}
+
+// ServeHTTP responds with a single batch, or a 500 for injected failures
+func (s *SyntheticServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	data, err := s.generator.batch()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
@@ -0,0 +1,95 @@
+package metrics
+
+import (
+	"context"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestNormal_SampleClamped(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	normal := Normal{Mean: 50, StdDev: 100, Min: 0, Max: 100}
+	for i := 0; i < 1000; i++ {
+		if v := normal.Sample(rng); v < 0 || 100 < v {
+			t.Fatalf("sample out of bounds: %v", v)
+		}
+	}
+}
+
+func TestSyntheticSource(t *testing.T) {
+	source := &SyntheticSource{Config: SyntheticConfig{
+		CPUCount:      4,
+		CPUUsage:      Constant(42),
+		BatchSize:     6,
+		ErrorRate:     0.2,
+		MalformedRate: 0.2,
+		Seed:          1,
+	}}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	resultStream, err := source.Start(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error in source.Start(): %v", err)
+	}
+
+	n, failed, malformed := 1000, 0, 0
+	for i := 0; i < n; i++ {
+		result := <-resultStream
+		if result.Error != nil {
+			if IsRetryable(result.Error) {
+				failed++
+			} else {
+				malformed++
+			}
+			continue
+		}
+		if len(result.Metrics) != 6 {
+			t.Fatalf("unexpected batch size: %v != 6 (observed, expected)", len(result.Metrics))
+		}
+		usages := result.Metrics[1].Payload.Value.(CPUUsage)
+		if len(usages) != 4 || usages[0] != 42 {
+			t.Fatalf("unexpected cpu usages: %v", usages)
+		}
+		handler := &CPUMetricsHandler{}
+		if err := handler.Handle(result.Metrics[1].Payload.Value); err != nil {
+			t.Fatalf("synthetic cpu usage rejected by handler: %v", err)
+		}
+		kernelHandler := &KernelMetricsHandler{}
+		if err := kernelHandler.Handle(result.Metrics[2].Payload.Value); err != nil {
+			t.Fatalf("synthetic kernel upgrade rejected by handler: %v", err)
+		}
+	}
+	// ErrorRate applies to every batch, MalformedRate to those that didn't fail
+	if failed < 150 || 250 < failed {
+		t.Errorf("unexpected number of failed batches: %v, expected ~200", failed)
+	}
+	if malformed < 110 || 210 < malformed {
+		t.Errorf("unexpected number of malformed batches: %v, expected ~160", malformed)
+	}
+}
+
+func TestSyntheticServer(t *testing.T) {
+	synthetic, err := NewSyntheticServer(SyntheticConfig{CPUCount: 2, Seed: 1})
+	if err != nil {
+		t.Fatalf("unexpected error in NewSyntheticServer(): %v", err)
+	}
+	server := httptest.NewServer(synthetic)
+	defer server.Close()
+
+	result := Target{Name: "synthetic", URL: server.URL}.fetch(context.Background(), 0)
+	if result.Error != nil {
+		t.Fatalf("unexpected error scraping synthetic server: %v", result.Error)
+	}
+	if len(result.Metrics) != 3 {
+		t.Errorf("unexpected batch size: %v != 3 (observed, expected)", len(result.Metrics))
+	}
+
+	failing, _ := NewSyntheticServer(SyntheticConfig{CPUCount: 2, ErrorRate: 1})
+	w := httptest.NewRecorder()
+	failing.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("unexpected status: %v != %v (observed, expected)", w.Code, http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,42 @@
+package metrics
+
+import "math"
+
+// UsageSummary summarises the CPU usage seen across all cores since startup.
+// Variance is the population variance, and StdDev its square root
+type UsageSummary struct {
+	Min      float64
+	Max      float64
+	Mean     float64
+	Variance float64
+	StdDev   float64
+}
+
+// welford keeps a running mean and variance with Welford's algorithm, which
+// stays accurate over long streams where summing squares would not
+type welford struct {
+	n    int
+	mean float64
+	m2   float64
+}
+
+// add updates the mean and sum of squared differences with a new value
+func (w *welford) add(value float64) {
+	w.n++
+	delta := value - w.mean
+	w.mean += delta / float64(w.n)
+	w.m2 += delta * (value - w.mean)
+}
+
+// variance returns the population variance, or 0 before any values
+func (w *welford) variance() float64 {
+	if w.n == 0 {
+		return 0
+	}
+	return w.m2 / float64(w.n)
+}
+
+// stdDev returns the population standard deviation
+func (w *welford) stdDev() float64 {
+	return math.Sqrt(w.variance())
+}
@@ -0,0 +1,69 @@
+package metrics
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestCPUUsageStats_Spread(t *testing.T) {
+	stats := CPUUsageStats{}
+	// The first core holds steady at 50%, the second bounces between 0 and 100%
+	for i := 0; i < 100; i++ {
+		stats.Update([]float64{50, float64(100 * (i % 2))})
+	}
+
+	if !reflect.DeepEqual(stats.Averages, []float64{50, 50}) {
+		t.Errorf("unexpected stats.Averages: %v != [50 50] (observed, expected)", stats.Averages)
+	}
+	if !reflect.DeepEqual(stats.Variances, []float64{0, 2500}) {
+		t.Errorf("unexpected stats.Variances: %v != [0 2500] (observed, expected)", stats.Variances)
+	}
+	if !reflect.DeepEqual(stats.StdDevs, []float64{0, 50}) {
+		t.Errorf("unexpected stats.StdDevs: %v != [0 50] (observed, expected)", stats.StdDevs)
+	}
+	if !reflect.DeepEqual(stats.Mins, []float64{50, 0}) {
+		t.Errorf("unexpected stats.Mins: %v != [50 0] (observed, expected)", stats.Mins)
+	}
+	if !reflect.DeepEqual(stats.Maxes, []float64{50, 100}) {
+		t.Errorf("unexpected stats.Maxes: %v != [50 100] (observed, expected)", stats.Maxes)
+	}
+	expected := UsageSummary{Min: 0, Max: 100, Mean: 50, Variance: 1250, StdDev: math.Sqrt(1250)}
+	observed := stats.Overall
+	if observed.Min != expected.Min || observed.Max != expected.Max ||
+		1e-9 < math.Abs(observed.Mean-expected.Mean) ||
+		1e-9 < math.Abs(observed.Variance-expected.Variance) ||
+		1e-9 < math.Abs(observed.StdDev-expected.StdDev) {
+		t.Errorf("unexpected stats.Overall: %+v != %+v (observed, expected)", observed, expected)
+	}
+}
+
+func TestWelford_Stable(t *testing.T) {
+	// Summing squares loses the variance of small changes on a large offset
+	w := welford{}
+	for i := 0; i < 1000000; i++ {
+		w.add(1e9 + float64(i%2))
+	}
+	if math.Abs(w.variance()-0.25) > 1e-6 {
+		t.Errorf("unexpected variance: %v != 0.25 (observed, expected)", w.variance())
+	}
+	if (&welford{}).variance() != 0 {
+		t.Errorf("unexpected variance of no values: %v != 0 (observed, expected)", (&welford{}).variance())
+	}
+}
+
+func TestCPUMetricsHandler_CurrentStatsSpread(t *testing.T) {
+	handler := &CPUMetricsHandler{}
+	handler.Handle(CPUUsage{10, 20})
+	handler.Handle(CPUUsage{30, 20})
+
+	statsCopy := handler.CurrentStats()
+	if statsCopy.Variances[0] != 100 || statsCopy.Mins[0] != 10 || statsCopy.Maxes[0] != 30 {
+		t.Errorf("unexpected stats for core 0: %+v", statsCopy)
+	}
+	statsCopy.Variances[0], statsCopy.Mins[0], statsCopy.Maxes[0] = 0, 0, 0
+	newCopy := handler.CurrentStats()
+	if newCopy.Variances[0] != 100 || newCopy.Mins[0] != 10 || newCopy.Maxes[0] != 30 {
+		t.Errorf("internal stats modified by external code")
+	}
+}
@@ -0,0 +1,131 @@
+package metrics
+
+import "time"
+
+// DefaultLoadWindows are the sliding windows a LoadMetricsHandler keeps stats
+// over, unless given its own
+var DefaultLoadWindows = []time.Duration{time.Minute, 5 * time.Minute, time.Hour}
+
+// WindowStats summarises the values seen within a sliding time window, to a
+// resolution of 1/60th of the window. Min, Max and Mean are zero while the
+// window is empty
+type WindowStats struct {
+	Window time.Duration
+	N      int
+	Min    float64
+	Max    float64
+	Mean   float64
+}
+
+// windowBuckets is the number of buckets each window is kept in, so a sample
+// counts toward a window for between 59/60ths of it and all of it, and memory
+// stays fixed however many samples arrive
+const windowBuckets = 60
+
+// windowBucket summarises the samples seen within one bucket's span of time
+type windowBucket struct {
+	index int64
+	n     int
+	sum   float64
+	min   float64
+	max   float64
+}
+
+// windowRing keeps the buckets of a single window, reusing each bucket's slot
+// once its span has left the window
+type windowRing struct {
+	window  time.Duration
+	width   time.Duration
+	buckets []windowBucket
+	latest  int64
+}
+
+// slidingWindow keeps bucketed stats over each of its windows
+type slidingWindow struct {
+	rings []windowRing
+}
+
+func newSlidingWindow(windows []time.Duration) *slidingWindow {
+	w := &slidingWindow{rings: make([]windowRing, len(windows))}
+	for i, window := range windows {
+		width := window / windowBuckets
+		if width <= 0 {
+			width = 1
+		}
+		w.rings[i] = windowRing{window: window, width: width, buckets: make([]windowBucket, windowBuckets)}
+	}
+	return w
+}
+
+// add records a value seen at the given time in every window it's still
+// within, as of the latest value seen
+func (w *slidingWindow) add(at time.Time, value float64) {
+	for i := range w.rings {
+		w.rings[i].add(at, value)
+	}
+}
+
+func (r *windowRing) add(at time.Time, value float64) {
+	index := r.index(at)
+	if index <= r.latest-windowBuckets {
+		return
+	}
+	if r.latest < index {
+		r.latest = index
+	}
+	bucket := &r.buckets[slot(index)]
+	if bucket.n == 0 || bucket.index != index {
+		*bucket = windowBucket{index: index, min: value, max: value}
+	}
+	bucket.n++
+	bucket.sum += value
+	if value < bucket.min {
+		bucket.min = value
+	}
+	if bucket.max < value {
+		bucket.max = value
+	}
+}
+
+// index returns the bucket the given time falls in
+func (r *windowRing) index(at time.Time) int64 {
+	return at.UnixNano() / int64(r.width)
+}
+
+// slot returns the position of a bucket in its ring
+func slot(index int64) int {
+	return int((index%windowBuckets + windowBuckets) % windowBuckets)
+}
+
+// stats returns the stats over each window as of now, in the order the
+// windows were given
+func (w *slidingWindow) stats(now time.Time) []WindowStats {
+	stats := make([]WindowStats, len(w.rings))
+	for i := range w.rings {
+		stats[i] = w.rings[i].stats(now)
+	}
+	return stats
+}
+
+func (r *windowRing) stats(now time.Time) WindowStats {
+	stats := WindowStats{Window: r.window}
+	oldest := r.index(now) - windowBuckets
+	total := 0.0
+	for _, bucket := range r.buckets {
+		if bucket.n == 0 || bucket.index <= oldest {
+			continue
+		}
+		if stats.N == 0 || bucket.min < stats.Min {
+			stats.Min = bucket.min
+		}
+		if stats.N == 0 || stats.Max < bucket.max {
+			stats.Max = bucket.max
+		}
+		stats.N += bucket.n
+		total += bucket.sum
+	}
+	if 0 < stats.N {
+		stats.Mean = total / float64(stats.N)
+	}
+	return stats
+}
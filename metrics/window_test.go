@@ -0,0 +1,94 @@
+package metrics
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestLoadStats_Windows(t *testing.T) {
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	stats := LoadStats{window: newSlidingWindow([]time.Duration{time.Minute, 5 * time.Minute})}
+	loads := []struct {
+		At   time.Duration
+		Load float64
+	}{
+		{0, 4},
+		{2 * time.Minute, 1},
+		{4*time.Minute + 30*time.Second, 3},
+		{5 * time.Minute, 2},
+	}
+	for _, load := range loads {
+		if err := stats.UpdateAt(load.Load, start.Add(load.At)); err != nil {
+			t.Fatalf("unexpected error in stats.UpdateAt(): %v", err)
+		}
+	}
+
+	// The first load has aged out of both windows, but not the all-time stats
+	observed := stats.window.stats(start.Add(5 * time.Minute))
+	expected := []WindowStats{
+		{Window: time.Minute, N: 2, Min: 2, Max: 3, Mean: 2.5},
+		{Window: 5 * time.Minute, N: 3, Min: 1, Max: 3, Mean: 2},
+	}
+	if !reflect.DeepEqual(observed, expected) {
+		t.Errorf("unexpected window stats: %+v != %+v (observed, expected)", observed, expected)
+	}
+	if stats.N != 4 || stats.Min != 1 || stats.Max != 4 {
+		t.Errorf("unexpected all-time stats: %+v", stats)
+	}
+
+	// Windows empty out once nothing new arrives
+	observed = stats.window.stats(start.Add(time.Hour))
+	expected = []WindowStats{{Window: time.Minute}, {Window: 5 * time.Minute}}
+	if !reflect.DeepEqual(observed, expected) {
+		t.Errorf("unexpected window stats: %+v != %+v (observed, expected)", observed, expected)
+	}
+}
+
+func TestSlidingWindow_Bounded(t *testing.T) {
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	window := newSlidingWindow([]time.Duration{time.Minute})
+	// A value every millisecond for two minutes, far more than the buckets
+	for i := 0; i < 120000; i++ {
+		window.add(start.Add(time.Duration(i)*time.Millisecond), float64(i%1000))
+	}
+	if len(window.rings[0].buckets) != windowBuckets {
+		t.Errorf("unexpected number of buckets: %v != %v (observed, expected)", len(window.rings[0].buckets), windowBuckets)
+	}
+
+	observed := window.stats(start.Add(2*time.Minute - time.Millisecond))
+	expected := []WindowStats{{Window: time.Minute, N: 60000, Min: 0, Max: 999, Mean: 499.5}}
+	if !reflect.DeepEqual(observed, expected) {
+		t.Errorf("unexpected window stats: %+v != %+v (observed, expected)", observed, expected)
+	}
+
+	// Values older than the window are ignored rather than resurrecting a
+	// bucket
+	window.add(start, 5000)
+	if observed := window.stats(start.Add(2*time.Minute - time.Millisecond)); observed[0].Max != 999 {
+		t.Errorf("unexpected max after a late value: %v != 999 (observed, expected)", observed[0].Max)
+	}
+}
+
+func TestLoadMetricsHandler_Windows(t *testing.T) {
+	handler := &LoadMetricsHandler{}
+	handler.Handle(LoadAverage(0.5))
+	handler.Handle(LoadAverage(1.5))
+
+	stats := handler.CurrentStats()
+	if len(stats.Windows) != len(DefaultLoadWindows) {
+		t.Fatalf("unexpected number of windows: %v != %v (observed, expected)", len(stats.Windows), len(DefaultLoadWindows))
+	}
+	for i, window := range stats.Windows {
+		expected := WindowStats{Window: DefaultLoadWindows[i], N: 2, Min: 0.5, Max: 1.5, Mean: 1}
+		if window != expected {
+			t.Errorf("unexpected window stats: %+v != %+v (observed, expected)", window, expected)
+		}
+	}
+
+	custom := &LoadMetricsHandler{Windows: []time.Duration{time.Second}}
+	custom.Handle(LoadAverage(0.5))
+	if windows := custom.CurrentStats().Windows; len(windows) != 1 || windows[0].Window != time.Second {
+		t.Errorf("unexpected custom windows: %+v", windows)
+	}
+}
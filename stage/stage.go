@@ -0,0 +1,288 @@
+// Package stage provides generic, cancellable pipeline stages. Every stage
+// runs in its own goroutines, closes its output once its input is exhausted or
+// its context is cancelled, and never blocks on a send or receive that ignores
+// cancellation, so no goroutine outlives a cancelled pipeline
+package stage
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// send delivers v on out, reporting false if ctx is cancelled first. A
+// cancelled ctx takes priority over a ready receiver, so nothing is sent once
+// cancellation is seen
+func send[T any](ctx context.Context, out chan<- T, v T) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	select {
+	case <-ctx.Done():
+		return false
+	case out <- v:
+		return true
+	}
+}
+
+// Repeat calls fn indefinitely, streaming each value it returns
+func Repeat[T any](ctx context.Context, fn func() T) <-chan T {
+	return RepeatWithDelay(ctx, fn, nil)
+}
+
+// RepeatWithDelay is like Repeat but waits for the duration returned by delay
+// before each call, so callers can space out or back off their calls
+func RepeatWithDelay[T any](ctx context.Context, fn func() T, delay func() time.Duration) <-chan T {
+	return RepeatWithDelayUntil(ctx, ctx, fn, delay)
+}
+
+// RepeatWithDelayUntil is like RepeatWithDelay, but makes no more calls once
+// stop is cancelled. The value of a call already made is still sent unless ctx
+// is cancelled too, so stopping drains rather than drops it
+func RepeatWithDelayUntil[T any](ctx, stop context.Context, fn func() T, delay func() time.Duration) <-chan T {
+	out := make(chan T)
+	go func() {
+		defer close(out)
+		for {
+			if delay != nil {
+				if d := delay(); 0 < d {
+					timer := time.NewTimer(d)
+					select {
+					case <-ctx.Done():
+						timer.Stop()
+						return
+					case <-stop.Done():
+						timer.Stop()
+						return
+					case <-timer.C:
+					}
+				}
+			}
+			if ctx.Err() != nil || stop.Err() != nil {
+				return
+			}
+			if !send(ctx, out, fn()) {
+				return
+			}
+		}
+	}()
+	return out
+}
+
+// Take streams the first n values off in
+func Take[T any](ctx context.Context, in <-chan T, n int) <-chan T {
+	out := make(chan T)
+	go func() {
+		defer close(out)
+		for i := 0; i < n; i++ {
+			select {
+			case <-ctx.Done():
+				return
+			case v, ok := <-in:
+				if ok == false || !send(ctx, out, v) {
+					return
+				}
+			}
+		}
+	}()
+	return out
+}
+
+// OrDone streams values off in until it's closed or ctx is cancelled,
+// enhancing for loop readability when ranging over a channel
+func OrDone[T any](ctx context.Context, in <-chan T) <-chan T {
+	out := make(chan T)
+	go func() {
+		defer close(out)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case v, ok := <-in:
+				if ok == false || !send(ctx, out, v) {
+					return
+				}
+			}
+		}
+	}()
+	return out
+}
+
+// Into is like OrDone but streams into the given channel, allowing callers to
+// choose its buffer size or measure it
+func Into[T any](ctx context.Context, in <-chan T, out chan T) <-chan T {
+	go func() {
+		defer close(out)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case v, ok := <-in:
+				if ok == false || !send(ctx, out, v) {
+					return
+				}
+			}
+		}
+	}()
+	return out
+}
+
+// Tee streams every value off in to both of the returned channels. Each value
+// is delivered to both before the next is read, so a slow reader of either
+// holds up the other
+func Tee[T any](ctx context.Context, in <-chan T) (<-chan T, <-chan T) {
+	out1, out2 := make(chan T), make(chan T)
+	go func() {
+		defer close(out1)
+		defer close(out2)
+		for v := range OrDone(ctx, in) {
+			out1, out2 := out1, out2
+			for i := 0; i < 2; i++ {
+				select {
+				case <-ctx.Done():
+					return
+				case out1 <- v:
+					out1 = nil
+				case out2 <- v:
+					out2 = nil
+				}
+			}
+		}
+	}()
+	return out1, out2
+}
+
+// FanIn merges the given channels in to one, closing it once every input has
+// closed
+func FanIn[T any](ctx context.Context, ins ...<-chan T) <-chan T {
+	var wg sync.WaitGroup
+	out := make(chan T)
+	multiplex := func(in <-chan T) {
+		defer wg.Done()
+		for v := range OrDone(ctx, in) {
+			if !send(ctx, out, v) {
+				return
+			}
+		}
+	}
+
+	wg.Add(len(ins))
+	for _, in := range ins {
+		go multiplex(in)
+	}
+	go func() {
+		wg.Wait()
+		close(out)
+	}()
+	return out
+}
+
+// FanOut spreads the values off in across n channels, each value going to
+// whichever reader is ready first, so n workers can share the input
+func FanOut[T any](ctx context.Context, in <-chan T, n int) []<-chan T {
+	outs := make([]<-chan T, n)
+	for i := range outs {
+		outs[i] = OrDone(ctx, in)
+	}
+	return outs
+}
+
+// Bridge flattens a stream of channels in to a single channel, reading each
+// channel in turn until it closes
+func Bridge[T any](ctx context.Context, chanStream <-chan <-chan T) <-chan T {
+	out := make(chan T)
+	go func() {
+		defer close(out)
+		for in := range OrDone(ctx, chanStream) {
+			for v := range OrDone(ctx, in) {
+				if !send(ctx, out, v) {
+					return
+				}
+			}
+		}
+	}()
+	return out
+}
+
+// Batch groups the values off in in to slices of up to size values. A partial
+// batch is flushed once maxWait (if non-zero) has passed since its first value,
+// and when in closes
+func Batch[T any](ctx context.Context, in <-chan T, size int, maxWait time.Duration) <-chan []T {
+	out := make(chan []T)
+	go func() {
+		defer close(out)
+		var batch []T
+		var timer *time.Timer
+		var timeout <-chan time.Time
+		flush := func() bool {
+			if timer != nil {
+				timer.Stop()
+				timer, timeout = nil, nil
+			}
+			if len(batch) == 0 {
+				return true
+			}
+			ok := send(ctx, out, batch)
+			batch = nil
+			return ok
+		}
+		defer func() {
+			if timer != nil {
+				timer.Stop()
+			}
+		}()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-timeout:
+				if !flush() {
+					return
+				}
+			case v, ok := <-in:
+				if ok == false {
+					flush()
+					return
+				}
+				batch = append(batch, v)
+				if len(batch) == 1 && 0 < maxWait {
+					timer = time.NewTimer(maxWait)
+					timeout = timer.C
+				}
+				if size <= len(batch) && !flush() {
+					return
+				}
+			}
+		}
+	}()
+	return out
+}
+
+// Map streams fn applied to each value off in
+func Map[T, U any](ctx context.Context, in <-chan T, fn func(T) U) <-chan U {
+	out := make(chan U)
+	go func() {
+		defer close(out)
+		for v := range OrDone(ctx, in) {
+			if !send(ctx, out, fn(v)) {
+				return
+			}
+		}
+	}()
+	return out
+}
+
+// Filter streams only the values off in for which keep returns true
+func Filter[T any](ctx context.Context, in <-chan T, keep func(T) bool) <-chan T {
+	out := make(chan T)
+	go func() {
+		defer close(out)
+		for v := range OrDone(ctx, in) {
+			if keep(v) && !send(ctx, out, v) {
+				return
+			}
+		}
+	}()
+	return out
+}
@@ -0,0 +1,258 @@
+package stage
+
+import (
+	"context"
+	"reflect"
+	"runtime"
+	"sort"
+	"testing"
+	"time"
+)
+
+// checkLeaks fails the test if it leaves more goroutines running than it
+// started with, giving stages a moment to exit after cancellation
+func checkLeaks(t *testing.T) {
+	before := runtime.NumGoroutine()
+	t.Cleanup(func() {
+		deadline := time.Now().Add(time.Second)
+		for runtime.NumGoroutine() > before && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+		if after := runtime.NumGoroutine(); after > before {
+			t.Errorf("leaked goroutines: %v > %v (observed, expected)", after, before)
+		}
+	})
+}
+
+// generate streams the given values, then closes
+func generate[T any](ctx context.Context, values ...T) <-chan T {
+	out := make(chan T)
+	go func() {
+		defer close(out)
+		for _, v := range values {
+			if !send(ctx, out, v) {
+				return
+			}
+		}
+	}()
+	return out
+}
+
+// collect reads every value off in until it closes
+func collect[T any](in <-chan T) []T {
+	values := make([]T, 0)
+	for v := range in {
+		values = append(values, v)
+	}
+	return values
+}
+
+// counter returns a function counting up from 1
+func counter() func() int {
+	i := 0
+	return func() int {
+		i++
+		return i
+	}
+}
+
+func TestRepeatAndTake(t *testing.T) {
+	checkLeaks(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	observed := collect(Take(ctx, Repeat(ctx, counter()), 3))
+	if expected := []int{1, 2, 3}; !reflect.DeepEqual(observed, expected) {
+		t.Errorf("unexpected values: %v != %v (observed, expected)", observed, expected)
+	}
+}
+
+func TestRepeatWithDelay(t *testing.T) {
+	checkLeaks(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	start := time.Now()
+	delay := func() time.Duration { return 10 * time.Millisecond }
+	collect(Take(ctx, RepeatWithDelay(ctx, counter(), delay), 3))
+	if elapsed := time.Since(start); elapsed < 30*time.Millisecond {
+		t.Errorf("unexpected elapsed time: %v < 30ms (observed, expected)", elapsed)
+	}
+}
+
+func TestRepeatWithDelayUntil_SendsLastValue(t *testing.T) {
+	checkLeaks(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stop, stopCalls := context.WithCancel(ctx)
+
+	// Stopping during the second call still sends its value
+	next := counter()
+	fn := func() int {
+		v := next()
+		if v == 2 {
+			stopCalls()
+		}
+		return v
+	}
+	observed := collect(RepeatWithDelayUntil(ctx, stop, fn, nil))
+	if expected := []int{1, 2}; !reflect.DeepEqual(observed, expected) {
+		t.Errorf("unexpected values: %v != %v (observed, expected)", observed, expected)
+	}
+}
+
+func TestTake_HonoursCancelWhileWaiting(t *testing.T) {
+	checkLeaks(t)
+	ctx, cancel := context.WithCancel(context.Background())
+
+	// Nothing is ever sent on in, so Take can only exit through ctx
+	taken := Take(ctx, make(chan int), 1)
+	cancel()
+	select {
+	case _, ok := <-taken:
+		if ok {
+			t.Error("expected no values from Take")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Take still blocked after cancel")
+	}
+}
+
+func TestTee(t *testing.T) {
+	checkLeaks(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	out1, out2 := Tee(ctx, generate(ctx, 1, 2, 3))
+	var observed1, observed2 []int
+	for v := range out1 {
+		observed1 = append(observed1, v)
+		observed2 = append(observed2, <-out2)
+	}
+	if expected := []int{1, 2, 3}; !reflect.DeepEqual(observed1, expected) || !reflect.DeepEqual(observed2, expected) {
+		t.Errorf("unexpected values: %v, %v != %v (observed, expected)", observed1, observed2, expected)
+	}
+}
+
+func TestFanInAndFanOut(t *testing.T) {
+	checkLeaks(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	workers := FanOut(ctx, generate(ctx, 1, 2, 3, 4, 5, 6), 3)
+	doubled := make([]<-chan int, len(workers))
+	for i, worker := range workers {
+		doubled[i] = Map(ctx, worker, func(v int) int { return v * 2 })
+	}
+	observed := collect(FanIn(ctx, doubled...))
+	sort.Ints(observed)
+	if expected := []int{2, 4, 6, 8, 10, 12}; !reflect.DeepEqual(observed, expected) {
+		t.Errorf("unexpected values: %v != %v (observed, expected)", observed, expected)
+	}
+}
+
+func TestBridge(t *testing.T) {
+	checkLeaks(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	chanStream := generate(ctx, generate(ctx, 1, 2), generate(ctx, 3))
+	observed := collect(Bridge(ctx, chanStream))
+	if expected := []int{1, 2, 3}; !reflect.DeepEqual(observed, expected) {
+		t.Errorf("unexpected values: %v != %v (observed, expected)", observed, expected)
+	}
+}
+
+func TestBatch(t *testing.T) {
+	checkLeaks(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	observed := collect(Batch(ctx, generate(ctx, 1, 2, 3, 4, 5), 2, 0))
+	if expected := [][]int{{1, 2}, {3, 4}, {5}}; !reflect.DeepEqual(observed, expected) {
+		t.Errorf("unexpected batches: %v != %v (observed, expected)", observed, expected)
+	}
+
+	// A partial batch is flushed after maxWait, without waiting for in to close
+	in := make(chan int)
+	batches := Batch(ctx, in, 10, 10*time.Millisecond)
+	in <- 1
+	select {
+	case batch := <-batches:
+		if !reflect.DeepEqual(batch, []int{1}) {
+			t.Errorf("unexpected batch: %v != [1] (observed, expected)", batch)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("partial batch not flushed after maxWait")
+	}
+	close(in)
+}
+
+func TestFilter(t *testing.T) {
+	checkLeaks(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	even := func(v int) bool { return v%2 == 0 }
+	observed := collect(Filter(ctx, generate(ctx, 1, 2, 3, 4), even))
+	if expected := []int{2, 4}; !reflect.DeepEqual(observed, expected) {
+		t.Errorf("unexpected values: %v != %v (observed, expected)", observed, expected)
+	}
+}
+
+func TestInto(t *testing.T) {
+	checkLeaks(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	out := make(chan int, 4)
+	observed := collect(Into(ctx, generate(ctx, 1, 2), out))
+	if expected := []int{1, 2}; !reflect.DeepEqual(observed, expected) {
+		t.Errorf("unexpected values: %v != %v (observed, expected)", observed, expected)
+	}
+}
+
+func TestInto_NothingSentOnceCancelled(t *testing.T) {
+	checkLeaks(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	// Both the input and the output are ready, but cancellation wins
+	in := make(chan int, 1)
+	in <- 1
+	out := make(chan int, 1)
+	if observed := collect(Into(ctx, in, out)); len(observed) != 0 {
+		t.Errorf("unexpected values sent after cancellation: %v", observed)
+	}
+}
+
+func TestStages_CancelMidStream(t *testing.T) {
+	stages := map[string]func(ctx context.Context, in <-chan int) <-chan int{
+		"OrDone": func(ctx context.Context, in <-chan int) <-chan int { return OrDone(ctx, in) },
+		"Take":   func(ctx context.Context, in <-chan int) <-chan int { return Take(ctx, in, 1000) },
+		"Map":    func(ctx context.Context, in <-chan int) <-chan int { return Map(ctx, in, func(v int) int { return v }) },
+		"Filter": func(ctx context.Context, in <-chan int) <-chan int {
+			return Filter(ctx, in, func(int) bool { return true })
+		},
+		"Tee": func(ctx context.Context, in <-chan int) <-chan int {
+			out, _ := Tee(ctx, in)
+			return out
+		},
+		"FanIn": func(ctx context.Context, in <-chan int) <-chan int { return FanIn(ctx, in, in) },
+		"Batch": func(ctx context.Context, in <-chan int) <-chan int {
+			return Map(ctx, Batch(ctx, in, 1, 0), func(batch []int) int { return batch[0] })
+		},
+	}
+	for name, stage := range stages {
+		t.Run(name, func(t *testing.T) {
+			checkLeaks(t)
+			ctx, cancel := context.WithCancel(context.Background())
+
+			// Abandon the stage part way through an endless stream, with
+			// values left unread
+			out := stage(ctx, Repeat(ctx, counter()))
+			<-out
+			cancel()
+		})
+	}
+}